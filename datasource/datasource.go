@@ -1,10 +1,73 @@
 package datasource
 
-import "github.com/arturom/datadiff/histogram"
+import (
+	"context"
 
-// DataSource describes a source of data containing records with numeric IDs
+	"github.com/arturom/datadiff/histogram"
+)
+
+// DataSource describes a source of data containing records with numeric IDs.
+// FetchHistogramAll bins the IDs on multiples of the interval, while FetchHistogramRange bins them from gte
+// so that the bins line up with the range whatever its size.
 type DataSource interface {
-	FetchHistogramAll(interval int) (histogram.Histogram, error)
-	FetchHistogramRange(gte, lt, interval int) (histogram.Histogram, error)
-	FetchIDRange(gte, lt int) ([]int, error)
+	FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error)
+	FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error)
+	FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error)
+}
+
+// Checksummer is implemented by data sources that can checksum the content of their records.
+// A record checksum is the CRC32 of its configured fields joined with "|", and when enabled
+// every histogram bin carries the XOR of the checksums of its records.
+type Checksummer interface {
+	// ChecksumsEnabled returns true if the fields to checksum are configured
+	ChecksumsEnabled() bool
+	// ChecksumEngine names the engine rendering the fields as text. Engines render values such as numbers,
+	// dates and booleans differently, so checksums are only comparable between sources of the same engine.
+	ChecksumEngine() string
+	// FetchChecksumRange fetches the checksum of every record in a given range, keyed by ID
+	FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error)
+}
+
+// Record maps the requested fields of a record to their values as returned by the data source
+type Record map[string]interface{}
+
+// RecordFetcher is implemented by data sources that can fetch whole records rather than only IDs
+type RecordFetcher interface {
+	// FetchRecordRange fetches the given fields of every record in a range, keyed by ID.
+	// Missing fields are left out of the record, and nested fields may be given as dotted paths.
+	FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error)
+}
+
+// RecordReader is implemented by data sources that can read whole records by ID, to be copied to another source
+type RecordReader interface {
+	// ReadRecords reads every field of the records with the given IDs, keyed by ID
+	ReadRecords(ctx context.Context, ids []int64) (map[int64]Record, error)
+}
+
+// FetchesRecords returns true if a data source implements RecordFetcher, and when it reports whether it
+// fetches records, like a sharded source whose shards differ, that it does
+func FetchesRecords(s DataSource) bool {
+	if c, ok := s.(interface{ FetchesRecords() bool }); ok {
+		return c.FetchesRecords()
+	}
+	_, ok := s.(RecordFetcher)
+	return ok
+}
+
+// ReadsRecords returns true if a data source implements RecordReader, and when it reports whether it
+// reads records, like a sharded source whose shards differ, that it does
+func ReadsRecords(s DataSource) bool {
+	if c, ok := s.(interface{ ReadsRecords() bool }); ok {
+		return c.ReadsRecords()
+	}
+	_, ok := s.(RecordReader)
+	return ok
+}
+
+// Writer is implemented by data sources that can be modified to match another data source
+type Writer interface {
+	// WriteRecords creates or replaces the given records, keyed by ID
+	WriteRecords(ctx context.Context, records map[int64]Record) error
+	// DeleteRecords removes the records with the given IDs
+	DeleteRecords(ctx context.Context, ids []int64) error
 }
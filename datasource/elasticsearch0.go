@@ -1,6 +1,14 @@
 package datasource
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
 	"github.com/arturom/datadiff/histogram"
 	"gopkg.in/olivere/elastic.v1"
 )
@@ -25,64 +33,223 @@ func NewES0DataSource(client *elastic.Client, index, typeName, field string) *ES
 }
 
 // FetchHistogramAll fetches a histogram of all IDs in an index
-func (s ES0DataSource) FetchHistogramAll(interval int) (histogram.Histogram, error) {
-	query := s.histogramQuery(interval)
-	return s.processQuery(query, interval)
+func (s ES0DataSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	return s.histogram(ctx, math.MinInt64, math.MaxInt64, 0, interval)
 }
 
 // FetchHistogramRange fetches a histogram of a selective range of IDs in an index
-func (s ES0DataSource) FetchHistogramRange(gte, lt, interval int) (histogram.Histogram, error) {
-	query := s.histogramQuery(interval).Query(s.rangeFilterQuery(gte, lt))
-	return s.processQuery(query, interval)
+func (s ES0DataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	return s.histogram(ctx, gte, lt, gte, interval)
+}
+
+// histogram bins the IDs of a range in bins laid out from origin
+func (s ES0DataSource) histogram(ctx context.Context, gte, lt, origin, interval int64) (histogram.Histogram, error) {
+	offset := origin - floorDiv(origin, interval)*interval
+	return exactHistogramRange(ctx, gte, lt, origin, interval, s.fetchDocs, func(ctx context.Context, gte, lt int64) (histogram.Histogram, error) {
+		query := s.histogramQuery(offset, interval).Query(s.rangeFilterQuery(gte, lt))
+		return s.processQuery(ctx, query, offset, interval)
+	}, func(ctx context.Context, gte, lt int64) (histogram.Histogram, error) {
+		return s.bin(ctx, gte, lt, origin, interval)
+	})
 }
 
-// FetchIDRange fetches all the existing IDs in a given range
-func (s ES0DataSource) FetchIDRange(gte, lt int) ([]int, error) {
-	r, err := s.client.
+// bin buckets the IDs of a range narrower than 2^63 exactly with a terms facet over binFacetScript. Terms facets
+// return as many terms as asked for, so the range is counted first to ask for a term per ID at most.
+func (s ES0DataSource) bin(ctx context.Context, gte, lt, origin, interval int64) (histogram.Histogram, error) {
+	// The 0.90 client cannot abort a request in flight, so cancellation is checked before the count
+	err := ctx.Err()
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+	count, err := s.client.Count(s.indexName).Type(s.typeName).Query(s.rangeFilterQuery(gte, lt)).Do()
+	if err != nil || count == 0 {
+		return histogram.Histogram{BinCapacity: interval}, err
+	}
+
+	facet := binFacet{
+		field:    s.fieldName,
+		first:    binStart(gte, origin, interval),
+		next:     nextBinStart(gte, origin, interval),
+		interval: interval,
+		size:     count,
+	}
+	query := s.client.
 		Search(s.indexName).
-		Query(s.rangeFilterQuery(gte, lt)).
 		Type(s.typeName).
-		Fields(s.fieldName).
-		Size(lt - gte).
-		Do()
+		Size(0).
+		Query(s.rangeFilterQuery(gte, lt)).
+		Facet(facetLabel, facet)
+	r, err := s.do(ctx, query)
 	if err != nil {
-		return nil, err
+		return histogram.Histogram{}, err
+	}
+
+	terms := r.Facets[facetLabel].Terms
+	b := make(histogram.Bins, len(terms))
+	for i, t := range terms {
+		key, err := strconv.ParseInt(t.Term, 10, 64)
+		if err != nil {
+			return histogram.Histogram{}, err
+		}
+		b[i] = histogram.Bin{
+			Key:   key,
+			Count: int64(t.Count),
+		}
+	}
+	h := histogram.Histogram{
+		BinCapacity: interval,
+		Bins:        b,
+	}
+	h.Sort()
+	return h, nil
+}
+
+// binFacetScript is binScript in MVEL, keying an ID with the start of its bin as a term
+const binFacetScript = "id = doc[field].value; id < next ? first : id - (id - next) % interval"
+
+// binFacet is a terms facet over binFacetScript. Histogram facets key buckets with doubles, while terms are exact.
+type binFacet struct {
+	field                 string
+	first, next, interval int64
+	size                  int64
+}
+
+func (f binFacet) Source() interface{} {
+	return map[string]interface{}{
+		"terms": map[string]interface{}{
+			"script_field": binFacetScript,
+			"params": map[string]interface{}{
+				"field":    f.field,
+				"first":    f.first,
+				"next":     f.next,
+				"interval": f.interval,
+			},
+			"size": f.size,
+		},
 	}
+}
 
-	hits := &r.Hits.Hits
+// fetchDocs fetches the IDs of a range, without checksums which this driver does not support
+func (s ES0DataSource) fetchDocs(ctx context.Context, gte, lt int64) ([]int64, []uint32, error) {
+	ids, err := s.FetchIDRange(ctx, gte, lt)
+	return ids, nil, err
+}
 
-	ids := make([]int, len(*hits))
+// FetchIDRange fetches all the existing IDs in a given range by scrolling through a scan, which
+// unlike from/size paging neither slows down on deep pages nor skips or repeats documents
+func (s ES0DataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	ids := []int64{}
+	scroll := s.client.
+		Scroll(s.indexName).
+		Type(s.typeName).
+		Query(s.rangeFilterQuery(gte, lt)).
+		Size(pageSize(gte, lt)).
+		KeepAlive(scrollKeepAlive)
+	for {
+		// The 0.90 client cannot abort a request in flight, so cancellation is checked between pages
+		err := ctx.Err()
+		if err != nil {
+			return nil, err
+		}
+		r, err := scroll.Do()
+		if err == elastic.EOS {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		scroll = scroll.ScrollId(r.ScrollId)
 
-	for i, h := range *hits {
-		ids[i] = int(h.Fields[s.fieldName].(float64))
+		// Read the ID from the raw source since fields are decoded as float64
+		for _, h := range r.Hits.Hits {
+			id, err := s.extractID(h)
+			if err != nil {
+				return nil, err
+			}
+			ids = append(ids, id)
+		}
 	}
 
+	// Scans return documents in no particular order
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
 	return ids, nil
 }
 
-func (s ES0DataSource) facet(interval int) elastic.Facet {
+// scrollKeepAlive is how long a scroll is kept open between pages
+const scrollKeepAlive = "1m"
+
+func (s ES0DataSource) extractID(hit *elastic.SearchHit) (int64, error) {
+	if hit.Source == nil {
+		return 0, fmt.Errorf("Missing source in hit %s", hit.Id)
+	}
+	source := make(map[string]json.RawMessage)
+	err := json.Unmarshal(*hit.Source, &source)
+	if err != nil {
+		return 0, err
+	}
+	var id json.Number
+	err = json.Unmarshal(source[s.fieldName], &id)
+	if err != nil {
+		return 0, err
+	}
+	return id.Int64()
+}
+
+// facet buckets the IDs less the offset, since histogram facets only lay out buckets from zero
+func (s ES0DataSource) facet(offset, interval int64) elastic.Facet {
+	if offset != 0 {
+		return elastic.
+			NewHistogramScriptFacet().
+			KeyScript("doc[field].value - offset").
+			ValueScript("doc[field].value").
+			Param("field", s.fieldName).
+			Param("offset", offset).
+			Interval(interval)
+	}
 	return elastic.
 		NewHistogramFacet().
 		Field(s.fieldName).
-		Interval(int64(interval))
+		Interval(interval)
 }
 
-func (s ES0DataSource) rangeFilterQuery(gte, lt int) elastic.Query {
+func (s ES0DataSource) rangeFilterQuery(gte, lt int64) elastic.Query {
 	return elastic.
 		NewFilteredQuery(elastic.NewMatchAllQuery()).
-		Filter(elastic.NewRangeFilter(s.fieldName))
+		Filter(elastic.NewRangeFilter(s.fieldName).Gte(gte).Lt(lt))
 }
 
-func (s ES0DataSource) histogramQuery(interval int) *elastic.SearchService {
+func (s ES0DataSource) histogramQuery(offset, interval int64) *elastic.SearchService {
 	return s.client.
 		Search(s.indexName).
 		Type(s.typeName).
 		Size(0).
-		Facet(facetLabel, s.facet(interval))
+		Facet(facetLabel, s.facet(offset, interval))
 }
 
-func (s ES0DataSource) processQuery(query *elastic.SearchService, interval int) (histogram.Histogram, error) {
+// do runs a search bounded by the context. The 0.90 client cannot abort a request in flight,
+// so the deadline is forwarded as a search timeout and timed out results are rejected.
+func (s ES0DataSource) do(ctx context.Context, query *elastic.SearchService) (*elastic.SearchResult, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	if d, ok := ctx.Deadline(); ok {
+		query = query.Timeout(fmt.Sprintf("%dms", max(time.Until(d).Milliseconds(), 1)))
+	}
 	r, err := query.Do()
+	if err != nil {
+		return nil, err
+	}
+	if r.TimedOut {
+		return nil, context.DeadlineExceeded
+	}
+	return r, nil
+}
+
+func (s ES0DataSource) processQuery(ctx context.Context, query *elastic.SearchService, offset, interval int64) (histogram.Histogram, error) {
+	r, err := s.do(ctx, query)
 	if err != nil {
 		return histogram.Histogram{}, err
 	}
@@ -92,8 +259,8 @@ func (s ES0DataSource) processQuery(query *elastic.SearchService, interval int)
 	b := make(histogram.Bins, len(*entries))
 	for i, e := range *entries {
 		b[i] = histogram.Bin{
-			Key:   int(e.Key.(float64)),
-			Count: e.Count,
+			Key:   snapBinKey(e.Key.(float64), 0, interval) + offset,
+			Count: int64(e.Count),
 		}
 	}
 
@@ -102,3 +269,5 @@ func (s ES0DataSource) processQuery(query *elastic.SearchService, interval int)
 		Bins:        b,
 	}, nil
 }
+
+var _ elastic.Facet = binFacet{}
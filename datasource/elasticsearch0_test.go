@@ -0,0 +1,145 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/arturom/datadiff/histogram"
+	"gopkg.in/olivere/elastic.v1"
+)
+
+func TestES0RangeFilterQuery(t *testing.T) {
+	s := ES0DataSource{fieldName: "id"}
+	tests := []struct {
+		gte, lt int64
+		want    string
+	}{
+		{5, 10, `{"filtered":{"filter":{"range":{"id":{"from":5,"include_lower":true,"include_upper":false,"to":10}}},"query":{"match_all":{}}}}`},
+		{-9223372036854775808, 9223372036854775807, `{"filtered":{"filter":{"range":{"id":{"from":-9223372036854775808,"include_lower":true,"include_upper":false,"to":9223372036854775807}}},"query":{"match_all":{}}}}`},
+		{9007199254740993, 9007199254740995, `{"filtered":{"filter":{"range":{"id":{"from":9007199254740993,"include_lower":true,"include_upper":false,"to":9007199254740995}}},"query":{"match_all":{}}}}`},
+	}
+	for _, tt := range tests {
+		got, err := json.Marshal(s.rangeFilterQuery(tt.gte, tt.lt).Source())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("rangeFilterQuery(%d, %d) = %s, want %s", tt.gte, tt.lt, got, tt.want)
+		}
+	}
+}
+
+func TestES0FetchIDRangeScrolls(t *testing.T) {
+	pages := [][]int64{{5, 3}, {9, 4}, {7}}
+	var scrolls []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `{"status":200}`)
+		case "/orders/order/_search":
+			if q := r.URL.Query(); q.Get("search_type") != "scan" || q.Get("size") != "1000" {
+				t.Errorf("unexpected scan parameters: %s", r.URL.RawQuery)
+			}
+			io.WriteString(w, `{"_scroll_id":"0","hits":{"total":5,"hits":[]}}`)
+		case "/_search/scroll":
+			b, _ := io.ReadAll(r.Body)
+			scrolls = append(scrolls, string(b))
+			n, _ := strconv.Atoi(string(b))
+			var hits []string
+			if n < len(pages) {
+				for _, id := range pages[n] {
+					hits = append(hits, fmt.Sprintf(`{"_id":"%d","_source":{"id":%d}}`, id, id))
+				}
+			}
+			fmt.Fprintf(w, `{"_scroll_id":"%d","hits":{"total":5,"hits":[%s]}}`, n+1, strings.Join(hits, ","))
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewClient(http.DefaultClient, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewES0DataSource(client, "orders", "order", "id")
+	got, err := s.FetchIDRange(context.Background(), 0, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{3, 4, 5, 7, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if want := []string{"0", "1", "2", "3"}; !reflect.DeepEqual(scrolls, want) {
+		t.Errorf("scrolled with %v, want %v", scrolls, want)
+	}
+}
+
+func TestES0BinsBeyondExactDoublesWithTerms(t *testing.T) {
+	var facet map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/":
+			io.WriteString(w, `{"status":200}`)
+		case "/orders/order/_count":
+			io.WriteString(w, `{"count":3}`)
+		case "/orders/order/_search":
+			var body struct {
+				Facets map[string]map[string]interface{} `json:"facets"`
+			}
+			dec := json.NewDecoder(r.Body)
+			dec.UseNumber()
+			err := dec.Decode(&body)
+			if err != nil {
+				t.Error(err)
+			}
+			facet = body.Facets[facetLabel]
+			// Terms are returned by count, not by key
+			io.WriteString(w, `{"hits":{"total":3,"hits":[]},"facets":{"ids":{"_type":"terms","terms":[`+
+				`{"term":"9007199254740995","count":2},{"term":"9007199254740993","count":1}]}}}`)
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+		}
+	}))
+	defer srv.Close()
+
+	client, err := elastic.NewClient(http.DefaultClient, srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewES0DataSource(client, "orders", "order", "id")
+	got, err := s.FetchHistogramRange(context.Background(), maxExactID+1, maxExactID+10000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := histogram.Histogram{
+		Bins:        histogram.Bins{{Key: maxExactID + 1, Count: 1}, {Key: maxExactID + 3, Count: 2}},
+		BinCapacity: 2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Bins are laid out from the range start, and as many terms are asked for as the range holds IDs
+	terms, _ := facet["terms"].(map[string]interface{})
+	if terms["script_field"] != binFacetScript || terms["size"] != json.Number("3") {
+		t.Errorf("got facet %v, want a terms facet of 3 terms over the bin script", facet)
+	}
+	params, _ := terms["params"].(map[string]interface{})
+	for name, want := range map[string]int64{"first": maxExactID + 1, "next": maxExactID + 1, "interval": 2} {
+		if params[name] != json.Number(strconv.FormatInt(want, 10)) {
+			t.Errorf("param %s = %v, want %d", name, params[name], want)
+		}
+	}
+}
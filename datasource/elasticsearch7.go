@@ -1,70 +1,328 @@
 package datasource
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sort"
 
 	h "github.com/arturom/datadiff/histogram"
 	elasticsearch "github.com/elastic/go-elasticsearch/v7"
+	"github.com/elastic/go-elasticsearch/v7/esapi"
 	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/some"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
 )
 
 type Elasticsearch7DataSource struct {
 	client *elasticsearch.Client
 	index  string
-	field  string
+	field  idField
+	// checksumFields are the fields compared when checking records for modifications
+	checksumFields []string
 }
 
 func NewElasticsearch7DataSource(client *elasticsearch.Client, index, field string) *Elasticsearch7DataSource {
 	return &Elasticsearch7DataSource{
 		client: client,
 		index:  index,
-		field:  field,
+		field:  idField{name: field},
 	}
 }
 
-func (es Elasticsearch7DataSource) FetchHistogramAll(interval int) (h.Histogram, error) {
-	req := createHistogramRequest(es.field, interval)
-	res, err := es.search(req)
+func (es Elasticsearch7DataSource) FetchHistogramAll(ctx context.Context, interval int64) (h.Histogram, error) {
+	return es.histogram(ctx, math.MinInt64, math.MaxInt64, 0, interval)
+}
+
+func (es Elasticsearch7DataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (h.Histogram, error) {
+	return es.histogram(ctx, gte, lt, gte, interval)
+}
+
+// histogram bins the IDs of a range in bins laid out from origin
+func (es Elasticsearch7DataSource) histogram(ctx context.Context, gte, lt, origin, interval int64) (h.Histogram, error) {
+	bin := func(ctx context.Context, gte, lt int64) (h.Histogram, error) {
+		return fetchBinPages(ctx, es, es.field, gte, lt, origin, interval, es.checksumFields)
+	}
+	// Histograms aggregate the IDs rather than their keys, so unsigned IDs are all binned with the script
+	if es.field.unsigned {
+		return exactHistogramRange(ctx, gte, lt, origin, interval, es.fetchDocs, bin, bin)
+	}
+	return exactHistogramRange(ctx, gte, lt, origin, interval, es.fetchDocs, func(ctx context.Context, gte, lt int64) (h.Histogram, error) {
+		req := createHistogramRequest(es.field.name, origin, interval)
+		req.Query = createRangeQuery(es.field, gte, lt)
+		if es.ChecksumsEnabled() {
+			addChecksumAggregation(req, es.checksumFields)
+		}
+		res, err := es.search(ctx, req)
+		if err != nil {
+			return h.Histogram{}, err
+		}
+		return extractHistogramFromResponse(res, origin, interval)
+	}, bin)
+}
+
+func (es Elasticsearch7DataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	return fetchIDPages(ctx, es, es.field, gte, lt)
+}
+
+func (es Elasticsearch7DataSource) ChecksumsEnabled() bool {
+	return len(es.checksumFields) != 0
+}
+
+// ChecksumEngine returns elasticsearch, as Elasticsearch and OpenSearch render fields with the same script
+func (es Elasticsearch7DataSource) ChecksumEngine() string {
+	return "elasticsearch"
+}
+
+func (es Elasticsearch7DataSource) FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error) {
+	if !es.ChecksumsEnabled() {
+		return nil, fmt.Errorf("No checksum fields configured for index %s", es.index)
+	}
+	return fetchChecksumPages(ctx, es, es.field, gte, lt, es.checksumFields)
+}
+
+// fetchDocs fetches the IDs of a range along with the checksums of their records when enabled
+func (es Elasticsearch7DataSource) fetchDocs(ctx context.Context, gte, lt int64) ([]int64, []uint32, error) {
+	return fetchDocPages(ctx, es, es.field, gte, lt, es.checksumFields)
+}
+
+func (es Elasticsearch7DataSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error) {
+	return fetchRecordPages(ctx, es, es.field, gte, lt, fields)
+}
+
+func (es Elasticsearch7DataSource) search(ctx context.Context, req *search.Request) (*searchResponse, error) {
+	buf, err := marshallRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	opts := []func(*esapi.SearchRequest){
+		es.client.Search.WithContext(ctx),
+		es.client.Search.WithBody(buf),
+	}
+	// A point in time already names the index, which must then be left out
+	if req.Pit == nil {
+		opts = append(opts, es.client.Search.WithIndex(es.index))
+	}
+	res, err := es.client.Search(opts...)
 	if err != nil {
-		return h.Histogram{}, err
+		return nil, err
 	}
-	return extractHistogramFromResponse(res, interval)
+
+	return readBody(res.Body)
 }
 
-func (es Elasticsearch7DataSource) FetchHistogramRange(gte, lte, interval int) (h.Histogram, error) {
-	req := createHistogramRequest(es.field, interval)
-	req.Query = createRangeQuery(gte, lte)
-	res, err := es.search(req)
+// openPointInTime opens a point in time of the index, which takes Elasticsearch 7.12 or later for _shard_doc
+func (es Elasticsearch7DataSource) openPointInTime(ctx context.Context) (string, error) {
+	res, err := es.client.OpenPointInTime(
+		es.client.OpenPointInTime.WithContext(ctx),
+		es.client.OpenPointInTime.WithIndex(es.index),
+		es.client.OpenPointInTime.WithKeepAlive(pointInTimeKeepAlive),
+	)
 	if err != nil {
-		return h.Histogram{}, err
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return "", fmt.Errorf("Failed to open a point in time of index %s: %s", es.index, res.String())
 	}
-	return extractHistogramFromResponse(res, interval)
+	pit := struct {
+		ID string `json:"id"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&pit)
+	return pit.ID, err
 }
 
-func (es Elasticsearch7DataSource) FetchIDRange(gte, lt int) ([]int, error) {
-	req := createIDRequest(es.field, gte, lt)
-	res, err := es.search(req)
+func (es Elasticsearch7DataSource) closePointInTime(ctx context.Context, id string) error {
+	body, err := json.Marshal(map[string]string{"id": id})
 	if err != nil {
-		return nil, err
+		return err
+	}
+	res, err := es.client.ClosePointInTime(
+		es.client.ClosePointInTime.WithContext(ctx),
+		es.client.ClosePointInTime.WithBody(bytes.NewReader(body)),
+	)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Failed to close a point in time of index %s: %s", es.index, res.String())
 	}
-	return extractIDsFromResponse(res, es.field)
+	return nil
 }
 
-func (es Elasticsearch7DataSource) search(req *search.Request) (*search.Response, error) {
-	buf, err := marshallRequest(req)
+// WriteRecords indexes the records in a single bulk request. Documents already holding an ID in the ID field
+// are replaced whatever their document IDs, and new documents are given their ID as document ID.
+// The ID field is set on every document so that it matches the field the source is compared on.
+func (es Elasticsearch7DataSource) WriteRecords(ctx context.Context, records map[int64]Record) error {
+	ids := make([]int64, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	// The ID field need not match the document IDs, so writing to the ID alone would duplicate modified records
+	docIDs, err := es.documentIDs(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, id := range ids {
+		r := records[id]
+		doc := make(Record, len(r)+1)
+		for k, v := range r {
+			doc[k] = v
+		}
+		doc[es.field.name] = es.field.value(id)
+
+		targets, ok := docIDs[id]
+		if !ok {
+			targets = []string{FormatID(id, es.field.unsigned)}
+		}
+		for _, docID := range targets {
+			err := enc.Encode(map[string]interface{}{
+				"index": map[string]string{"_index": es.index, "_id": docID},
+			})
+			if err != nil {
+				return err
+			}
+			err = enc.Encode(doc)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	res, err := es.client.Bulk(&buf, es.client.Bulk.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Bulk request failed: %s", res.String())
+	}
+	return checkBulkResponse(res.Body)
+}
+
+// documentIDs looks up the document IDs of the documents holding the IDs in the ID field
+func (es Elasticsearch7DataSource) documentIDs(ctx context.Context, ids []int64) (map[int64][]string, error) {
+	q := types.NewQuery()
+	q.Terms = &types.TermsQuery{
+		TermsQuery: map[string]types.TermsQueryField{es.field.name: es.field.values(ids)},
+	}
+	req := &search.Request{
+		Size:    some.Int(idPageSize),
+		Query:   q,
+		Source_: es.field.name,
+		Sort:    []types.SortCombinations{es.field.name},
+	}
+
+	docIDs := make(map[int64][]string)
+	err := fetchPages(ctx, es, req, func(res *searchResponse) error {
+		for _, hit := range res.Hits.Hits {
+			id, err := extractID(hit.Source, es.field)
+			if err != nil {
+				return err
+			}
+			docIDs[id] = append(docIDs[id], hit.ID)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	res, err := es.client.Search(
-		es.client.Search.WithContext(context.Background()),
-		es.client.Search.WithIndex(es.index),
-		es.client.Search.WithBody(buf),
+	return docIDs, nil
+}
+
+// DeleteRecords deletes the documents whose ID field matches the IDs, whatever their document IDs are
+func (es Elasticsearch7DataSource) DeleteRecords(ctx context.Context, ids []int64) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"query": map[string]interface{}{
+			"terms": map[string][]json.Number{es.field.name: es.field.values(ids)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	res, err := es.client.DeleteByQuery(
+		[]string{es.index},
+		bytes.NewReader(body),
+		es.client.DeleteByQuery.WithContext(ctx),
+		es.client.DeleteByQuery.WithConflicts("proceed"),
 	)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		return fmt.Errorf("Delete by query failed: %s", res.String())
 	}
 
-	return readBody(res.Body)
+	result := struct {
+		Failures []json.RawMessage `json:"failures"`
+	}{}
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	if len(result.Failures) != 0 {
+		return fmt.Errorf("Delete by query failed for %d documents: %s", len(result.Failures), result.Failures[0])
+	}
+	return nil
+}
+
+// validateField checks that the ID field is mapped as a numeric type in the index
+func (es Elasticsearch7DataSource) validateField() error {
+	res, err := es.client.Indices.GetFieldMapping(
+		[]string{es.field.name},
+		es.client.Indices.GetFieldMapping.WithContext(context.Background()),
+		es.client.Indices.GetFieldMapping.WithIndex(es.index),
+	)
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		res.Body.Close()
+		return fmt.Errorf("Failed to fetch mapping of field %s: %s", es.field.name, res.Status())
+	}
+	return checkFieldMapping(res.Body, es.field)
+}
+
+// checkBulkResponse returns the first item error of a bulk response
+func checkBulkResponse(body io.Reader) error {
+	result := struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID    string          `json:"_id"`
+			Error json.RawMessage `json:"error"`
+		} `json:"items"`
+	}{}
+	err := json.NewDecoder(body).Decode(&result)
+	if err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	for _, item := range result.Items {
+		for action, r := range item {
+			if r.Error != nil {
+				return fmt.Errorf("Bulk %s of document %s failed: %s", action, r.ID, r.Error)
+			}
+		}
+	}
+	return fmt.Errorf("Bulk request failed")
 }
 
 var _ DataSource = (*Elasticsearch7DataSource)(nil)
+var _ Writer = (*Elasticsearch7DataSource)(nil)
+var _ RecordFetcher = (*Elasticsearch7DataSource)(nil)
+var _ Checksummer = (*Elasticsearch7DataSource)(nil)
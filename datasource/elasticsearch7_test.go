@@ -0,0 +1,154 @@
+package datasource
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	es7 "github.com/elastic/go-elasticsearch/v7"
+)
+
+func newTestES7(t *testing.T, ids ...int64) (*fakeES, *Elasticsearch7DataSource) {
+	f, srv := newFakeES(t, "orders", "id", ids...)
+	client, err := es7.NewClient(es7.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, NewElasticsearch7DataSource(client, "orders", "id")
+}
+
+func TestElasticsearch7WriteRecordsReplacesByIDField(t *testing.T) {
+	// The documents holding IDs 10 and 20 have the document IDs 0 and 1, and ID 20 is duplicated as 2
+	f, es := newTestES7(t, 10, 20, 20)
+
+	err := es.WriteRecords(context.Background(), map[int64]Record{
+		20: {"name": "updated"},
+		30: {"name": "new"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]interface{}{
+		"0":  {"id": int64(10)},
+		"1":  {"id": int64(20), "name": "updated"},
+		"2":  {"id": int64(20), "name": "updated"},
+		"30": {"id": int64(30), "name": "new"},
+	}
+	if got := f.indexed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestElasticsearch7WriteRecordsOfUnsignedIDs(t *testing.T) {
+	f, srv := newUnsignedFakeES(t, "orders", "id", 1<<63+10)
+	client, err := es7.NewClient(es7.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := NewElasticsearch7DataSource(client, "orders", "id")
+	es.field.unsigned = true
+
+	// Records are keyed by the keys of their IDs, 10 being 2^63 + 10
+	err = es.WriteRecords(context.Background(), map[int64]Record{
+		10: {"name": "updated"},
+		20: {"name": "new"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]map[string]interface{}{
+		"0":                   {"id": uint64(1<<63 + 10), "name": "updated"},
+		"9223372036854775828": {"id": uint64(1<<63 + 20), "name": "new"},
+	}
+	if got := f.indexed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Deletes match the IDs of the keys
+	err = es.DeleteRecords(context.Background(), []int64{10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "0")
+	if got := f.indexed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestElasticsearch7UsesIDField(t *testing.T) {
+	f, srv := newFakeES(t, "orders", "doc_id", 3, 1, 2, 15)
+	client, err := es7.NewClient(es7.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := NewElasticsearch7DataSource(client, "orders", "doc_id")
+	_, err = es.FetchIDRange(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = es.FetchHistogramRange(context.Background(), 0, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The range query, the sort and the histogram all apply to the ID field
+	for _, req := range f.searched() {
+		if _, ok := req["query"].(map[string]interface{})["range"].(map[string]interface{})["doc_id"]; !ok {
+			t.Errorf("range = %v, want it on doc_id", req["query"])
+		}
+	}
+	if sort := f.searched()[0]["sort"].([]interface{}); sort[0] != "doc_id" {
+		t.Errorf("sort = %v, want it on doc_id first", sort)
+	}
+	agg := f.searched()[1]["aggregations"].(map[string]interface{})["ids"].(map[string]interface{})["histogram"].(map[string]interface{})
+	if agg["field"] != "doc_id" {
+		t.Errorf("histogram field = %v, want doc_id", agg["field"])
+	}
+}
+
+func TestElasticsearch7ValidateField(t *testing.T) {
+	f, s := newTestES7(t)
+	err := s.validateField()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mapAs("keyword")
+	err = s.validateField()
+	if err == nil || !strings.Contains(err.Error(), "non-numeric type: keyword") {
+		t.Errorf("got error %v, want a non-numeric type error", err)
+	}
+
+	f.mapAs("")
+	err = s.validateField()
+	if err == nil || !strings.Contains(err.Error(), "Field id is not mapped in index orders") {
+		t.Errorf("got error %v, want an unmapped field error", err)
+	}
+}
+
+func TestElasticsearch7FetchIDRangeFromPointInTime(t *testing.T) {
+	// The last ID of the first page is held by a second document that sorts into the next page
+	var ids []int64
+	for i := int64(0); i < idPageSize; i++ {
+		ids = append(ids, i)
+	}
+	ids = append(ids, idPageSize-1, idPageSize-1)
+	f, es := newTestES7(t, ids...)
+	got, err := es.FetchIDRange(context.Background(), 0, 2*idPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != idPageSize+2 {
+		t.Fatalf("got %d IDs, want %d", len(got), idPageSize+2)
+	}
+	for _, req := range f.searched()[1:] {
+		if sort := req["sort"]; !reflect.DeepEqual(sort, []interface{}{"id", "_shard_doc"}) {
+			t.Errorf("sort = %v, want [id _shard_doc]", sort)
+		}
+	}
+	if f.pits != 1 || f.openPits != 0 {
+		t.Errorf("opened %d points in time and left %d open, want one closed", f.pits, f.openPits)
+	}
+}
@@ -4,69 +4,300 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math"
+	"net/http"
+	"strings"
 
 	h "github.com/arturom/datadiff/histogram"
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
 	"github.com/elastic/go-elasticsearch/v8/typedapi/some"
 	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types/enums/valuetype"
 )
 
 type Elasticsearch8DataSource struct {
 	client *elasticsearch.TypedClient
 	index  string
-	field  string
+	field  idField
+	// checksumFields are the fields compared when checking records for modifications
+	checksumFields []string
 }
 
 func NewElasticsearch8DataSource(client *elasticsearch.TypedClient, index, field string) *Elasticsearch8DataSource {
 	return &Elasticsearch8DataSource{
 		client: client,
 		index:  index,
-		field:  field,
+		field:  idField{name: field},
 	}
 }
-func (es Elasticsearch8DataSource) FetchHistogramAll(interval int) (h.Histogram, error) {
-	res, err := es.client.Search().
-		Index(es.index).
-		Request(&search.Request{
-			Size: some.Int(0),
-			Aggregations: map[string]types.Aggregations{
-				"ids": {
-					Histogram: &types.HistogramAggregation{
-						Field:    &es.field,
-						Interval: some.Float64(float64(interval)),
-					},
-				},
-			},
-		}).
-		Do(context.Background())
+
+func (es Elasticsearch8DataSource) FetchHistogramAll(ctx context.Context, interval int64) (h.Histogram, error) {
+	return es.histogram(ctx, math.MinInt64, math.MaxInt64, 0, interval)
+}
+
+func (es Elasticsearch8DataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (h.Histogram, error) {
+	return es.histogram(ctx, gte, lt, gte, interval)
+}
+
+// histogram bins the IDs of a range in bins laid out from origin
+func (es Elasticsearch8DataSource) histogram(ctx context.Context, gte, lt, origin, interval int64) (h.Histogram, error) {
+	bin := func(ctx context.Context, gte, lt int64) (h.Histogram, error) {
+		return fetchBinPages(ctx, es, es.field, gte, lt, origin, interval, es.checksumFields)
+	}
+	// Histograms aggregate the IDs rather than their keys, so unsigned IDs are all binned with the script
+	if es.field.unsigned {
+		return exactHistogramRange(ctx, gte, lt, origin, interval, es.fetchDocs, bin, bin)
+	}
+	return exactHistogramRange(ctx, gte, lt, origin, interval, es.fetchDocs, func(ctx context.Context, gte, lt int64) (h.Histogram, error) {
+		req := createHistogramRequest(es.field.name, origin, interval)
+		req.Query = createRangeQuery(es.field, gte, lt)
+		if es.ChecksumsEnabled() {
+			addChecksumAggregation(req, es.checksumFields)
+		}
+		res, err := es.search(ctx, req)
+		if err != nil {
+			return h.Histogram{}, err
+		}
+		return extractHistogramFromResponse(res, origin, interval)
+	}, bin)
+}
+
+func (es Elasticsearch8DataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	return fetchIDPages(ctx, es, es.field, gte, lt)
+}
+
+func (es Elasticsearch8DataSource) ChecksumsEnabled() bool {
+	return len(es.checksumFields) != 0
+}
+
+// ChecksumEngine returns elasticsearch, as Elasticsearch and OpenSearch render fields with the same script
+func (es Elasticsearch8DataSource) ChecksumEngine() string {
+	return "elasticsearch"
+}
+
+func (es Elasticsearch8DataSource) FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error) {
+	if !es.ChecksumsEnabled() {
+		return nil, fmt.Errorf("No checksum fields configured for index %s", es.index)
+	}
+	return fetchChecksumPages(ctx, es, es.field, gte, lt, es.checksumFields)
+}
+
+// fetchDocs fetches the IDs of a range along with the checksums of their records when enabled
+func (es Elasticsearch8DataSource) fetchDocs(ctx context.Context, gte, lt int64) ([]int64, []uint32, error) {
+	return fetchDocPages(ctx, es, es.field, gte, lt, es.checksumFields)
+}
+
+func (es Elasticsearch8DataSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error) {
+	return fetchRecordPages(ctx, es, es.field, gte, lt, fields)
+}
+
+func (es Elasticsearch8DataSource) search(ctx context.Context, req *search.Request) (*searchResponse, error) {
+	// A point in time already names the index, which must then be left out
+	s := es.client.Search()
+	if req.Pit == nil {
+		s = s.Index(es.index)
+	}
+	// Perform rather than Do, since the typed response decodes numbers as float64
+	res, err := s.Request(req).Perform(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return readBody(res.Body)
+}
+
+func (es Elasticsearch8DataSource) openPointInTime(ctx context.Context) (string, error) {
+	res, err := es.client.OpenPointInTime(es.index).KeepAlive(pointInTimeKeepAlive).Do(ctx)
 	if err != nil {
-		return h.Histogram{}, err
+		return "", err
 	}
-	return extractHistogramFromResponse(res, interval)
+	return res.Id, nil
 }
 
-func (es Elasticsearch8DataSource) FetchHistogramRange(gte, lte, interval int) (h.Histogram, error) {
-	return h.Histogram{}, nil
+func (es Elasticsearch8DataSource) closePointInTime(ctx context.Context, id string) error {
+	_, err := es.client.ClosePointInTime().Id(id).Do(ctx)
+	return err
 }
 
-func (es Elasticsearch8DataSource) FetchIDRange(gte, lt int) ([]int, error) {
-	return []int{}, nil
+// validateField checks that the ID field is mapped as a numeric type in the index
+func (es Elasticsearch8DataSource) validateField() error {
+	res, err := es.client.Indices.
+		GetFieldMapping(es.field.name).
+		Index(es.index).
+		Perform(context.Background())
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= http.StatusMultipleChoices {
+		res.Body.Close()
+		return fmt.Errorf("Failed to fetch mapping of field %s: %s", es.field.name, res.Status)
+	}
+	return checkFieldMapping(res.Body, es.field)
 }
 
 var _ DataSource = (*Elasticsearch8DataSource)(nil)
+var _ RecordFetcher = (*Elasticsearch8DataSource)(nil)
+var _ Checksummer = (*Elasticsearch8DataSource)(nil)
+
+// idPageSize is the number of IDs fetched per request, kept below the default max_result_window
+const idPageSize = 1000
 
-func createRangeQuery(gte, lt int) *types.Query {
+// pageSize returns the number of IDs fetched per request from a range, without overflowing on ranges wider than int64.
+// Narrow ranges fetch one more than they hold without duplicates, so that a short page tells they fit in it.
+func pageSize(gte, lt int64) int {
+	if uint64(lt)-uint64(gte) < idPageSize {
+		return int(lt-gte) + 1
+	}
+	return idPageSize
+}
+
+// maxExactID bounds the IDs that Elasticsearch histograms count exactly. Values are aggregated as doubles,
+// which cannot tell integers apart past 2^53, so bucket keys and the bucket every ID falls in are rounded.
+const maxExactID = 1 << 53
+
+// exactHistogramRange aggregates the IDs of a range within ±2^53 into a histogram, and bins the IDs beyond it
+// exactly with bin. Bins are laid out from origin. The IDs beyond ±2^53 of ranges taking no more than a page are
+// binned from the IDs themselves, which are stored exactly, as fetchDocs takes a single request without a script.
+// fetchDocs returns the checksums of the records along with their IDs when checksums are enabled.
+func exactHistogramRange(ctx context.Context, gte, lt, origin, interval int64, fetchDocs func(ctx context.Context, gte, lt int64) ([]int64, []uint32, error), aggregate, bin func(ctx context.Context, gte, lt int64) (h.Histogram, error)) (h.Histogram, error) {
+	bins := make(map[int64]h.Bin)
+	if from, to := max(gte, -maxExactID), min(lt, maxExactID); from < to {
+		hist, err := aggregate(ctx, from, to)
+		if err != nil {
+			return h.Histogram{}, err
+		}
+		for _, b := range hist.Bins {
+			bins[b.Key] = b
+		}
+	}
+	for _, r := range [][2]int64{{gte, min(lt, -maxExactID)}, {max(gte, maxExactID), lt}} {
+		if r[0] >= r[1] {
+			continue
+		}
+		if uint64(r[1])-uint64(r[0]) > idPageSize {
+			hist, err := bin(ctx, r[0], r[1])
+			if err != nil {
+				return h.Histogram{}, err
+			}
+			for _, b := range hist.Bins {
+				bins[b.Key] = b
+			}
+			continue
+		}
+		ids, checksums, err := fetchDocs(ctx, r[0], r[1])
+		if err != nil {
+			return h.Histogram{}, err
+		}
+		for i, id := range ids {
+			key := binStart(id, origin, interval)
+			b := bins[key]
+			b.Key = key
+			b.Count++
+			if checksums != nil {
+				b.Checksum ^= checksums[i]
+			}
+			bins[key] = b
+		}
+	}
+
+	hist := h.Histogram{
+		Bins:        make(h.Bins, 0, len(bins)),
+		BinCapacity: interval,
+	}
+	for _, b := range bins {
+		hist.Bins = append(hist.Bins, b)
+	}
+	hist.Sort()
+	return hist, nil
+}
+
+// numericFieldTypes lists the Elasticsearch field types that can be aggregated into a histogram
+var numericFieldTypes = map[string]bool{
+	"long":          true,
+	"integer":       true,
+	"short":         true,
+	"byte":          true,
+	"unsigned_long": true,
+	"double":        true,
+	"float":         true,
+	"half_float":    true,
+	"scaled_float":  true,
+}
+
+// checkFieldMapping reads a get-field-mapping response and verifies that the field is numeric in every index,
+// and mapped as unsigned_long when it holds unsigned IDs
+func checkFieldMapping(body io.ReadCloser, field idField) error {
+	defer body.Close()
+	indices := make(map[string]struct {
+		Mappings map[string]struct {
+			Mapping map[string]struct {
+				Type string `json:"type"`
+			} `json:"mapping"`
+		} `json:"mappings"`
+	})
+	err := json.NewDecoder(body).Decode(&indices)
+	if err != nil {
+		return err
+	}
+	if len(indices) == 0 {
+		return fmt.Errorf("No index found for field %s", field.name)
+	}
+	for index, m := range indices {
+		f, ok := m.Mappings[field.name]
+		if !ok {
+			return fmt.Errorf("Field %s is not mapped in index %s", field.name, index)
+		}
+		for _, p := range f.Mapping {
+			if !numericFieldTypes[p.Type] {
+				return fmt.Errorf("Field %s in index %s has non-numeric type: %s", field.name, index, p.Type)
+			}
+			if field.unsigned && p.Type != "unsigned_long" {
+				return fmt.Errorf("Field %s in index %s holds unsigned IDs but has type: %s", field.name, index, p.Type)
+			}
+		}
+	}
+	return nil
+}
+
+// idField names the ID field of an index. Unsigned IDs are held in an unsigned_long field and compared
+// through their keys, which queries and documents convert back to the IDs.
+type idField struct {
+	name     string
+	unsigned bool
+}
+
+// value returns the ID of a key as a JSON number, which is encoded exactly
+func (f idField) value(key int64) json.Number {
+	return json.Number(FormatID(key, f.unsigned))
+}
+
+func (f idField) values(keys []int64) []json.Number {
+	values := make([]json.Number, len(keys))
+	for i, key := range keys {
+		values[i] = f.value(key)
+	}
+	return values
+}
+
+func createRangeQuery(field idField, gte, lt int64) *types.Query {
+	// A plain map keeps the bounds as exact integers; NumberRangeQuery would encode them as float64
 	q := types.NewQuery()
-	rangeQ := types.NewNumberRangeQuery()
-	rangeQ.Gte = some.Float64(float64(gte))
-	rangeQ.Lt = some.Float64(float64(lt))
-	q.Range["id"] = rangeQ
+	q.Range[field.name] = map[string]json.Number{
+		"gte": field.value(gte),
+		"lt":  field.value(lt),
+	}
 	return q
 }
 
-func createHistogramRequest(field string, interval int) *search.Request {
+// createHistogramRequest aggregates the ID field into buckets of the interval laid out from origin
+func createHistogramRequest(field string, origin, interval int64) *search.Request {
+	var offset *types.Float64
+	if o := origin - floorDiv(origin, interval)*interval; o != 0 {
+		offset = some.Float64(float64(o))
+	}
 	return &search.Request{
 		Size: some.Int(0),
 		Aggregations: map[string]types.Aggregations{
@@ -74,86 +305,376 @@ func createHistogramRequest(field string, interval int) *search.Request {
 				Histogram: &types.HistogramAggregation{
 					Field:    some.String(field),
 					Interval: some.Float64(float64(interval)),
+					Offset:   offset,
+					// Empty buckets are of no use, and would otherwise span the whole range of IDs
+					MinDocCount: some.Int(1),
 				},
 			},
 		},
 	}
 }
 
-func createIDRequest(field string, gte, lt int) *search.Request {
+// binScript keys an ID with the start of its bin. The bins are laid out from next, the first bin start past the
+// start of the range, and the IDs before it fall in the bin first. Longs are computed exactly, unlike histograms,
+// and never overflow for ranges narrower than 2^63. Scripts read unsigned_long values as the bits of a long,
+// whose top bit is flipped to key unsigned IDs like UnsignedKey.
+const binScript = `long id = ((Number) doc[params.field].value).longValue();
+if (params.unsigned) { id ^= Long.MIN_VALUE; }
+return id < params.next ? params.first : id - (id - params.next) % params.interval;`
+
+// binPageSize is the number of bins fetched per request when binning with binScript
+const binPageSize = 1000
+
+// createBinRequest buckets the IDs of a range narrower than 2^63 by the bin binScript keys them with,
+// with bins laid out from origin
+func createBinRequest(field idField, gte, lt, origin, interval int64) *search.Request {
+	params := make(map[string]json.RawMessage)
+	for name, value := range map[string]interface{}{
+		"field":    field.name,
+		"unsigned": field.unsigned,
+		"first":    binStart(gte, origin, interval),
+		"next":     nextBinStart(gte, origin, interval),
+		"interval": interval,
+	} {
+		params[name], _ = json.Marshal(value)
+	}
 	return &search.Request{
-		Size:    some.Int(lt - gte),
-		Query:   createRangeQuery(gte, lt),
-		Source_: field,
+		Size:  some.Int(0),
+		Query: createRangeQuery(field, gte, lt),
+		Aggregations: map[string]types.Aggregations{
+			"ids": {
+				Composite: &types.CompositeAggregation{
+					Size: some.Int(binPageSize),
+					Sources: []map[string]types.CompositeAggregationSource{{
+						"bin": {
+							Terms: &types.CompositeTermsAggregation{
+								Script:    types.InlineScript{Source: binScript, Params: params},
+								ValueType: &valuetype.Long,
+							},
+						},
+					}},
+				},
+			},
+		},
 	}
 }
 
-func marshallRequest(req *search.Request) (*bytes.Buffer, error) {
-	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(req)
-	if err != nil {
-		return nil, err
+// fetchBinPages bins the IDs of a range narrower than 2^63 exactly on the cluster, following the after_key of
+// the composite aggregation until every bin is fetched. Bins carry checksums when checksum fields are given.
+func fetchBinPages(ctx context.Context, p pager, field idField, gte, lt, origin, interval int64, checksumFields []string) (h.Histogram, error) {
+	req := createBinRequest(field, gte, lt, origin, interval)
+	if len(checksumFields) != 0 {
+		addChecksumAggregation(req, checksumFields)
+	}
+	hist := h.Histogram{
+		Bins:        h.Bins{},
+		BinCapacity: interval,
+	}
+	for {
+		res, err := p.search(ctx, req)
+		if err != nil {
+			return h.Histogram{}, err
+		}
+		page, err := extractHistogramFromResponse(res, origin, interval)
+		if err != nil {
+			return h.Histogram{}, err
+		}
+		hist.Bins = append(hist.Bins, page.Bins...)
+
+		after, ok := res.Aggregations["ids"].AfterKey["bin"]
+		if len(page.Bins) < binPageSize || !ok {
+			return hist, nil
+		}
+		req.Aggregations["ids"].Composite.After = types.CompositeAggregateKey{"bin": after}
 	}
-	return &buf, nil
 }
 
-func readBody(body io.ReadCloser) (*search.Response, error) {
-	res := search.NewResponse()
-	defer body.Close()
-	bytes, err := io.ReadAll(body)
+func createIDRequest(field idField, gte, lt int64) *search.Request {
+	return &search.Request{
+		Size:    some.Int(pageSize(gte, lt)),
+		Query:   createRangeQuery(field, gte, lt),
+		Source_: field.name,
+		Sort:    []types.SortCombinations{field.name},
+	}
+}
+
+// fetchIDPages pages through all the IDs in a range using search_after sorted on the ID field
+func fetchIDPages(ctx context.Context, p pager, field idField, gte, lt int64) ([]int64, error) {
+	ids := []int64{}
+	err := fetchPages(ctx, p, createIDRequest(field, gte, lt), func(res *searchResponse) error {
+		page, err := extractIDsFromResponse(res, field)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, page...)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	err = res.UnmarshalJSON(bytes)
+	return ids, nil
+}
+
+// fetchRecordPages pages through all the records in a range, reading the requested fields from _source
+func fetchRecordPages(ctx context.Context, p pager, field idField, gte, lt int64, fields []string) (map[int64]Record, error) {
+	records := make(map[int64]Record)
+	req := createIDRequest(field, gte, lt)
+	req.Source_ = append([]string{field.name}, fields...)
+	err := fetchPages(ctx, p, req, func(res *searchResponse) error {
+		for _, hit := range res.Hits.Hits {
+			id, err := extractID(hit.Source, field)
+			if err != nil {
+				return err
+			}
+			r := make(Record, len(fields))
+			for _, f := range fields {
+				v, ok, err := lookupSource(hit.Source, f)
+				if err != nil {
+					return err
+				}
+				if ok {
+					r[f] = v
+				}
+			}
+			records[id] = r
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	return res, nil
+	return records, nil
 }
 
-func extractHistogramFromResponse(res *search.Response, interval int) (h.Histogram, error) {
-	agg := res.Aggregations["ids"]
+// pager searches an index page by page
+type pager interface {
+	// search runs a request against the index, or against the point in time of the request when it has one
+	search(ctx context.Context, req *search.Request) (*searchResponse, error)
+	// openPointInTime opens a point in time of the index, returning an empty ID for clusters that page without one
+	openPointInTime(ctx context.Context) (string, error)
+	closePointInTime(ctx context.Context, id string) error
+}
+
+// pointInTimeKeepAlive is how long a point in time is kept between two pages
+const pointInTimeKeepAlive = "1m"
+
+// fetchPages runs a request sorted on the ID field, following it with search_after until a page comes back short.
+// Documents sharing an ID sort in no set order, so search_after could skip or repeat the ones past a page boundary.
+// Ranges taking more than one page are therefore read again from a point in time sorted on _shard_doc as well,
+// or sorted on _id for clusters without points in time, which are both unique.
+func fetchPages(ctx context.Context, p pager, req *search.Request, handle func(*searchResponse) error) (err error) {
+	// A single page holds the whole range in any order, which spares most ranges opening a point in time
+	res, err := p.search(ctx, req)
+	if err != nil {
+		return err
+	}
+	if hits := res.Hits.Hits; len(hits) < *req.Size {
+		return handle(res)
+	}
+
+	id, err := p.openPointInTime(ctx)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		req.Sort = append(req.Sort, "_id")
+	} else {
+		req.Sort = append(req.Sort, "_shard_doc")
+		req.Pit = &types.PointInTimeReference{Id: id, KeepAlive: pointInTimeKeepAlive}
+		defer func() {
+			// The point in time is closed even when the context is cancelled, so that it does not hold on to resources
+			closeErr := p.closePointInTime(context.WithoutCancel(ctx), req.Pit.Id)
+			if err == nil {
+				err = closeErr
+			}
+		}()
+	}
+	for {
+		res, err := p.search(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		err = handle(res)
+		if err != nil {
+			return err
+		}
 
-	// JSON marshall/unmarshall hack to avoid writing type conversion code
+		hits := res.Hits.Hits
+		if len(hits) == 0 || len(hits) < *req.Size {
+			return nil
+		}
+		req.SearchAfter = hits[len(hits)-1].Sort
+		// Every page may return a new ID for the point in time
+		if res.PitID != "" {
+			req.Pit.Id = res.PitID
+		}
+	}
+}
+
+func marshallRequest(req *search.Request) (*bytes.Buffer, error) {
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(agg)
+	err := json.NewEncoder(&buf).Encode(req)
 	if err != nil {
-		return h.Histogram{}, err
+		return nil, err
 	}
-	ids := types.NewHistogramAggregate()
-	ids.UnmarshalJSON(buf.Bytes())
+	return &buf, nil
+}
 
-	return extractHistogram(ids, interval), nil
+// searchResponse holds the parts of a search response used by the data sources.
+// IDs and keys are decoded as json.Number so that 64-bit values are not rounded through float64.
+type searchResponse struct {
+	Error json.RawMessage `json:"error"`
+	PitID string          `json:"pit_id"`
+	Hits  struct {
+		Hits []struct {
+			ID     string                     `json:"_id"`
+			Source map[string]json.RawMessage `json:"_source"`
+			Fields map[string][]json.Number   `json:"fields"`
+			Sort   []types.FieldValue         `json:"sort"`
+		} `json:"hits"`
+	} `json:"hits"`
+	Aggregations map[string]struct {
+		AfterKey map[string]json.Number `json:"after_key"`
+		Buckets  []struct {
+			Key      json.RawMessage `json:"key"`
+			DocCount int64           `json:"doc_count"`
+			Checksum *struct {
+				Value json.Number `json:"value"`
+			} `json:"checksum"`
+		} `json:"buckets"`
+	} `json:"aggregations"`
+}
+
+func readBody(body io.ReadCloser) (*searchResponse, error) {
+	defer body.Close()
+	res := &searchResponse{}
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	err := dec.Decode(res)
+	if err != nil {
+		return nil, err
+	}
+	if res.Error != nil {
+		return nil, fmt.Errorf("Search failed: %s", res.Error)
+	}
+	return res, nil
 }
 
-func extractHistogram(agg *types.HistogramAggregate, capacity int) h.Histogram {
-	buckets := agg.Buckets.([]types.HistogramBucket)
+func extractHistogramFromResponse(res *searchResponse, origin, interval int64) (h.Histogram, error) {
+	buckets := res.Aggregations["ids"].Buckets
 	bins := make(h.Bins, len(buckets))
 	for i, bucket := range buckets {
+		key, err := parseBinKey(bucket.Key, origin, interval)
+		if err != nil {
+			return h.Histogram{}, err
+		}
 		bins[i] = h.Bin{
-			Key:   int(bucket.Key),
-			Count: int(bucket.DocCount),
+			Key:   key,
+			Count: bucket.DocCount,
+		}
+		if bucket.Checksum != nil {
+			checksum, err := bucket.Checksum.Value.Int64()
+			if err != nil {
+				return h.Histogram{}, err
+			}
+			bins[i].Checksum = uint32(checksum)
 		}
 	}
 	return h.Histogram{
 		Bins:        bins,
-		BinCapacity: capacity,
-	}
+		BinCapacity: interval,
+	}, nil
 }
 
-func extractIDsFromResponse(res *search.Response, field string) ([]int, error) {
-	result := make([]int, len(res.Hits.Hits))
-	for i, hit := range res.Hits.Hits {
-		source := make(map[string]json.Number)
-		err := json.Unmarshal(hit.Source_, &source)
+// parseBinKey converts a bucket key to an exact bin key, with bins laid out from origin. Histogram keys are
+// numbers, while the composite buckets of createBinRequest are keyed with an object holding the exact bin.
+func parseBinKey(raw json.RawMessage, origin, interval int64) (int64, error) {
+	if bytes.HasPrefix(raw, []byte("{")) {
+		var key map[string]json.Number
+		err := json.Unmarshal(raw, &key)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		val, err := source[field].Int64()
+		return key["bin"].Int64()
+	}
+	var key json.Number
+	err := json.Unmarshal(raw, &key)
+	if err != nil {
+		return 0, err
+	}
+	if k, err := key.Int64(); err == nil {
+		return k, nil
+	}
+	f, err := key.Float64()
+	if err != nil {
+		return 0, err
+	}
+	return snapBinKey(f, origin, interval), nil
+}
+
+// snapBinKey rounds a floating point bin key to the nearest bin start, the origin plus a multiple of the interval.
+// Elasticsearch computes histogram keys as doubles, so this recovers the exact key
+// as long as the interval is larger than the rounding error at that magnitude.
+func snapBinKey(key float64, origin, interval int64) int64 {
+	return origin + int64(math.Round((key-float64(origin))/float64(interval)))*interval
+}
+
+func extractIDsFromResponse(res *searchResponse, field idField) ([]int64, error) {
+	result := make([]int64, len(res.Hits.Hits))
+	for i, hit := range res.Hits.Hits {
+		val, err := extractID(hit.Source, field)
 		if err != nil {
 			return nil, err
 		}
-		result[i] = int(val)
+		result[i] = val
 	}
 	return result, nil
 }
+
+func extractID(source map[string]json.RawMessage, field idField) (int64, error) {
+	var id json.Number
+	err := json.Unmarshal(source[field.name], &id)
+	if err != nil {
+		return 0, err
+	}
+	return ParseID(id.String(), field.unsigned)
+}
+
+// lookupSource reads a field from a document source, following dotted paths into nested objects
+// unless the source holds the dotted name as a key of its own
+func lookupSource(source map[string]json.RawMessage, path string) (interface{}, bool, error) {
+	raw, ok := source[path]
+	rest := ""
+	if !ok {
+		var key string
+		key, rest, _ = strings.Cut(path, ".")
+		raw, ok = source[key]
+		if !ok {
+			return nil, false, nil
+		}
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	err := dec.Decode(&v)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, key := range strings.Split(rest, ".") {
+		if key == "" {
+			continue
+		}
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false, nil
+		}
+		v, ok = m[key]
+		if !ok {
+			return nil, false, nil
+		}
+	}
+	return v, true, nil
+}
@@ -0,0 +1,387 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"hash/crc32"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	h "github.com/arturom/datadiff/histogram"
+	es8 "github.com/elastic/go-elasticsearch/v8"
+)
+
+func newTestES8(t *testing.T, ids ...int64) (*fakeES, *Elasticsearch8DataSource) {
+	f, srv := newFakeES(t, "orders", "id", ids...)
+	client, err := es8.NewTypedClient(es8.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, NewElasticsearch8DataSource(client, "orders", "id")
+}
+
+func TestElasticsearch8FetchHistogramRange(t *testing.T) {
+	f, es := newTestES8(t, 3, 1, 2, 15, 1005, 2000, -4)
+	got, err := es.FetchHistogramRange(context.Background(), 0, 2000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := h.Histogram{
+		Bins:        h.Bins{{Key: 0, Count: 3}, {Key: 10, Count: 1}, {Key: 1000, Count: 1}},
+		BinCapacity: 10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	req := f.searched()[0]
+	agg := req["aggregations"].(map[string]interface{})["ids"].(map[string]interface{})["histogram"].(map[string]interface{})
+	if agg["min_doc_count"] != json.Number("1") {
+		t.Errorf("min_doc_count = %v, want 1", agg["min_doc_count"])
+	}
+	bounds := req["query"].(map[string]interface{})["range"].(map[string]interface{})["id"]
+	if want := map[string]interface{}{"gte": json.Number("0"), "lt": json.Number("2000")}; !reflect.DeepEqual(bounds, want) {
+		t.Errorf("range = %v, want %v", bounds, want)
+	}
+}
+
+func TestElasticsearch8FetchHistogramRangeFromItsStart(t *testing.T) {
+	// The bins start at the lower bound of the range rather than on multiples of the interval
+	f, es := newTestES8(t, 3, 1, 2, 15, 16, -4)
+	got, err := es.FetchHistogramRange(context.Background(), 2, 17, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := h.Histogram{
+		Bins:        h.Bins{{Key: 2, Count: 2}, {Key: 12, Count: 2}},
+		BinCapacity: 10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	agg := f.searched()[0]["aggregations"].(map[string]interface{})["ids"].(map[string]interface{})["histogram"].(map[string]interface{})
+	if agg["offset"] != json.Number("2") {
+		t.Errorf("offset = %v, want 2", agg["offset"])
+	}
+}
+
+func TestElasticsearch8FetchHistogramAllBeyondExactDoubles(t *testing.T) {
+	// Doubles round 2^53+1 down to 2^53 and 2^53+3 up to 2^53+4, which would put them in the wrong bins
+	_, es := newTestES8(t, 7, maxExactID+1, maxExactID+3, -maxExactID-3)
+	got, err := es.FetchHistogramAll(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := h.Histogram{
+		Bins: h.Bins{
+			{Key: -maxExactID - 4, Count: 1},
+			{Key: 6, Count: 1},
+			{Key: maxExactID, Count: 1},
+			{Key: maxExactID + 2, Count: 1},
+		},
+		BinCapacity: 2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestElasticsearch8BinsBeyondExactDoublesOnTheCluster(t *testing.T) {
+	// More bins than fit in a page of the composite aggregation, so that it is followed past its after key
+	var ids []int64
+	for i := int64(0); i < binPageSize+10; i++ {
+		ids = append(ids, maxExactID+1+3*i, maxExactID+2+3*i)
+	}
+	f, es := newTestES8(t, ids...)
+	got, err := es.FetchHistogramAll(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Bins) != binPageSize+10 {
+		t.Fatalf("got %d bins, want %d", len(got.Bins), binPageSize+10)
+	}
+	for i, b := range got.Bins {
+		// 2^53+1 is a multiple of 3, which doubles cannot tell from 2^53
+		if want := (h.Bin{Key: maxExactID + 1 + 3*int64(i), Count: 2}); b != want {
+			t.Fatalf("bin %d = %v, want %v", i, b, want)
+		}
+	}
+
+	// The IDs are bucketed on the cluster rather than paged through
+	searched := f.searched()
+	var composite, after int
+	for _, req := range searched {
+		if req["size"] != json.Number("0") {
+			t.Errorf("searched %v, want only aggregations", req)
+		}
+		agg := req["aggregations"].(map[string]interface{})["ids"].(map[string]interface{})
+		if c, ok := agg["composite"].(map[string]interface{}); ok {
+			composite++
+			if _, ok := c["after"]; ok {
+				after++
+			}
+		}
+	}
+	// IDs below -2^53 take a page, and the ones above 2^53 a first page and another past its after key
+	if composite != 3 || after != 1 {
+		t.Errorf("got %d composite pages of which %d after a key, want 3 of which 1", composite, after)
+	}
+}
+
+func TestElasticsearch8BinsNarrowRangeBeyondExactDoublesFromIDs(t *testing.T) {
+	f, es := newTestES8(t, maxExactID+1, maxExactID+3)
+	got, err := es.FetchHistogramRange(context.Background(), maxExactID, maxExactID+10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := h.Histogram{
+		Bins:        h.Bins{{Key: maxExactID, Count: 1}, {Key: maxExactID + 2, Count: 1}},
+		BinCapacity: 2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// A range taking no more than a page is binned from its IDs, sparing a script
+	if searched := f.searched(); len(searched) != 1 || searched[0]["aggregations"] != nil {
+		t.Errorf("searched %v, want a single page of IDs", searched)
+	}
+}
+
+func TestElasticsearch8FetchIDRange(t *testing.T) {
+	var ids []int64
+	for i := int64(2499); i >= 0; i-- {
+		ids = append(ids, i)
+	}
+	f, es := newTestES8(t, ids...)
+	got, err := es.FetchIDRange(context.Background(), 100, 2300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2200 {
+		t.Fatalf("got %d IDs, want 2200", len(got))
+	}
+	for i, id := range got {
+		if id != int64(100+i) {
+			t.Fatalf("ID %d = %d, want %d", i, id, 100+i)
+		}
+	}
+	// The first page is read again along with the others from a point in time, closed once done
+	searched := f.searched()
+	if n := len(searched); n != 4 {
+		t.Errorf("got %d requests, want a first page followed by 3 pages", n)
+	}
+	for _, req := range searched[1:] {
+		if sort := req["sort"]; !reflect.DeepEqual(sort, []interface{}{"id", "_shard_doc"}) {
+			t.Errorf("sort = %v, want [id _shard_doc]", sort)
+		}
+		if pit := req["pit"].(map[string]interface{}); pit["id"] != "pit-1" || pit["keep_alive"] != pointInTimeKeepAlive {
+			t.Errorf("pit = %v, want pit-1 kept alive for %s", pit, pointInTimeKeepAlive)
+		}
+	}
+	if f.pits != 1 || f.openPits != 0 {
+		t.Errorf("opened %d points in time and left %d open, want one closed", f.pits, f.openPits)
+	}
+}
+
+func TestElasticsearch8FetchIDRangeSmallerThanPage(t *testing.T) {
+	f, es := newTestES8(t, 1, 2, 3, 4)
+	got, err := es.FetchIDRange(context.Background(), 2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{2, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if size := f.searched()[0]["size"]; size != json.Number("3") {
+		t.Errorf("size = %v, want 3", size)
+	}
+	if f.pits != 0 {
+		t.Errorf("opened %d points in time, want none for a single page", f.pits)
+	}
+}
+
+func TestElasticsearch8FetchIDRangeDuplicatesAcrossPages(t *testing.T) {
+	// The last ID of the first page is held by a second document that sorts into the next page
+	var ids []int64
+	for i := int64(0); i < idPageSize; i++ {
+		ids = append(ids, i)
+	}
+	ids = append(ids, idPageSize-1, idPageSize-1)
+	_, es := newTestES8(t, ids...)
+	got, err := es.FetchIDRange(context.Background(), 0, 2*idPageSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != idPageSize+2 {
+		t.Fatalf("got %d IDs, want %d", len(got), idPageSize+2)
+	}
+	for _, id := range got[idPageSize-1:] {
+		if id != idPageSize-1 {
+			t.Errorf("got ID %d past the first page, want %d", id, idPageSize-1)
+		}
+	}
+}
+
+func TestElasticsearch8Checksums(t *testing.T) {
+	f, es := newTestES8(t)
+	f.add(
+		map[string]interface{}{"id": int64(1), "name": "a", "meta": map[string]interface{}{"v": int64(7)}},
+		map[string]interface{}{"id": int64(2), "name": "b"},
+		map[string]interface{}{"id": int64(15), "name": "c", "meta": map[string]interface{}{"v": int64(8)}},
+		map[string]interface{}{"id": int64(maxExactID + 1), "name": "d"},
+	)
+	es.checksumFields = []string{"name", "meta.v"}
+	crc := func(s string) uint32 {
+		return crc32.ChecksumIEEE([]byte(s))
+	}
+
+	got, err := es.FetchHistogramAll(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := h.Histogram{
+		Bins: h.Bins{
+			{Key: 0, Count: 2, Checksum: crc("a|7") ^ crc("b")},
+			{Key: 10, Count: 1, Checksum: crc("c|8")},
+			{Key: maxExactID - 2, Count: 1, Checksum: crc("d")},
+		},
+		BinCapacity: 10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	checksums, err := es.FetchChecksumRange(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int64]uint32{1: crc("a|7"), 2: crc("b")}; !reflect.DeepEqual(checksums, want) {
+		t.Errorf("got checksums %v, want %v", checksums, want)
+	}
+}
+
+func TestElasticsearch8ChecksumsDisabled(t *testing.T) {
+	f, es := newTestES8(t, 1, 2)
+	if es.ChecksumsEnabled() {
+		t.Fatal("checksums enabled without checksum fields")
+	}
+	_, err := es.FetchHistogramAll(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.searched()[0]["aggregations"].(map[string]interface{})["ids"].(map[string]interface{})["aggregations"]; ok {
+		t.Errorf("checksums aggregated without checksum fields")
+	}
+	_, err = es.FetchChecksumRange(context.Background(), 0, 10)
+	if err == nil {
+		t.Errorf("fetched checksums without checksum fields")
+	}
+}
+
+func TestElasticsearch8UsesIDField(t *testing.T) {
+	f, srv := newFakeES(t, "orders", "doc_id", 3, 1, 2, 15)
+	client, err := es8.NewTypedClient(es8.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := NewElasticsearch8DataSource(client, "orders", "doc_id")
+	_, err = es.FetchIDRange(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = es.FetchHistogramRange(context.Background(), 0, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The range query, the sort and the histogram all apply to the ID field
+	for _, req := range f.searched() {
+		if _, ok := req["query"].(map[string]interface{})["range"].(map[string]interface{})["doc_id"]; !ok {
+			t.Errorf("range = %v, want it on doc_id", req["query"])
+		}
+	}
+	if sort := f.searched()[0]["sort"].([]interface{}); sort[0] != "doc_id" {
+		t.Errorf("sort = %v, want it on doc_id first", sort)
+	}
+	agg := f.searched()[1]["aggregations"].(map[string]interface{})["ids"].(map[string]interface{})["histogram"].(map[string]interface{})
+	if agg["field"] != "doc_id" {
+		t.Errorf("histogram field = %v, want doc_id", agg["field"])
+	}
+}
+
+func TestElasticsearch8ValidateField(t *testing.T) {
+	f, s := newTestES8(t)
+	err := s.validateField()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mapAs("keyword")
+	err = s.validateField()
+	if err == nil || !strings.Contains(err.Error(), "non-numeric type: keyword") {
+		t.Errorf("got error %v, want a non-numeric type error", err)
+	}
+
+	f.mapAs("")
+	err = s.validateField()
+	if err == nil || !strings.Contains(err.Error(), "Field id is not mapped in index orders") {
+		t.Errorf("got error %v, want an unmapped field error", err)
+	}
+}
+
+func TestElasticsearch8UnsignedIDs(t *testing.T) {
+	// IDs past 2^63 are compared through their keys, 2^63 + 5 being the key 5
+	f, srv := newUnsignedFakeES(t, "orders", "id", 3, 1<<63+5, 1<<63+6, math.MaxUint64-1)
+	client, err := es8.NewTypedClient(es8.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	es := NewElasticsearch8DataSource(client, "orders", "id")
+	es.field.unsigned = true
+	err = es.validateField()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := es.FetchHistogramAll(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := h.Histogram{
+		Bins:        h.Bins{{Key: math.MinInt64, Count: 1}, {Key: 0, Count: 2}, {Key: math.MaxInt64 - 807, Count: 1}},
+		BinCapacity: 1000,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	// Histograms would aggregate the IDs rather than their keys, so every bin comes from the bin script
+	for _, req := range f.searched() {
+		ids := req["aggregations"].(map[string]interface{})["ids"].(map[string]interface{})
+		if _, ok := ids["composite"]; !ok {
+			t.Errorf("got aggregation %v, want a composite one", ids)
+		}
+	}
+
+	ids, err := es.FetchIDRange(context.Background(), math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{math.MinInt64 + 3, 5, 6, math.MaxInt64 - 1}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+	searched := f.searched()
+	bounds := searched[len(searched)-1]["query"].(map[string]interface{})["range"].(map[string]interface{})["id"]
+	if want := map[string]interface{}{"gte": json.Number("0"), "lt": json.Number("18446744073709551615")}; !reflect.DeepEqual(bounds, want) {
+		t.Errorf("range = %v, want %v", bounds, want)
+	}
+
+	// Unsigned IDs past 2^63 only fit an unsigned_long field
+	f.mapAs("long")
+	err = es.validateField()
+	if err == nil || !strings.Contains(err.Error(), "holds unsigned IDs but has type: long") {
+		t.Errorf("got error %v, want an unsigned type error", err)
+	}
+}
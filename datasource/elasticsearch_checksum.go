@@ -0,0 +1,133 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/types"
+)
+
+// checksumFunctions declares a Painless function computing the CRC32 of the UTF-8 text of the checksum
+// fields joined with '|', like CRC32(CONCAT_WS('|', ...)) in MySQL. Fields are read from _source, following
+// dotted paths, and missing or null fields are skipped the way CONCAT_WS skips NULL.
+const checksumFunctions = `
+long crcByte(long crc, int b) {
+  crc ^= b;
+  for (int k = 0; k < 8; k++) {
+    crc = (crc & 1L) != 0 ? (crc >>> 1) ^ 0xEDB88320L : crc >>> 1;
+  }
+  return crc;
+}
+long checksum(def source, List fields) {
+  long crc = 0xFFFFFFFFL;
+  boolean first = true;
+  for (String field : fields) {
+    def value = source;
+    for (String key : field.splitOnToken('.')) {
+      value = value instanceof Map ? value.get(key) : null;
+    }
+    if (value == null) {
+      continue;
+    }
+    String text = first ? value.toString() : '|' + value.toString();
+    first = false;
+    int i = 0;
+    while (i < text.length()) {
+      int c = text.codePointAt(i);
+      i += c >= 0x10000 ? 2 : 1;
+      if (c < 0x80) {
+        crc = crcByte(crc, c);
+        continue;
+      }
+      int n = c < 0x800 ? 2 : c < 0x10000 ? 3 : 4;
+      crc = crcByte(crc, ((0xFF00 >> n) & 0xFF) | (c >> (6 * (n - 1))));
+      for (int j = n - 2; j >= 0; j--) {
+        crc = crcByte(crc, 0x80 | ((c >> (6 * j)) & 0x3F));
+      }
+    }
+  }
+  return crc ^ 0xFFFFFFFFL;
+}
+`
+
+// checksumParams passes the checksum fields to the scripts
+func checksumParams(fields []string) map[string]json.RawMessage {
+	raw, _ := json.Marshal(fields)
+	return map[string]json.RawMessage{"fields": raw}
+}
+
+// addChecksumAggregation XORs the checksums of the records of every histogram bucket with a scripted metric
+func addChecksumAggregation(req *search.Request, fields []string) {
+	ids := req.Aggregations["ids"]
+	ids.Aggregations = map[string]types.Aggregations{
+		"checksum": {
+			ScriptedMetric: &types.ScriptedMetricAggregation{
+				InitScript:    types.InlineScript{Source: "state.checksum = 0L;"},
+				MapScript:     types.InlineScript{Source: checksumFunctions + "state.checksum ^= checksum(params['_source'], params.fields);"},
+				CombineScript: types.InlineScript{Source: "return state.checksum;"},
+				ReduceScript:  types.InlineScript{Source: "long checksum = 0L; for (def s : states) { if (s != null) { checksum ^= (long) s; } } return checksum;"},
+				Params:        checksumParams(fields),
+			},
+		},
+	}
+	req.Aggregations["ids"] = ids
+}
+
+// fetchDocPages pages through the IDs of a range along with the checksums of their records, computed by a
+// script field. The checksums are nil when no checksum fields are given.
+func fetchDocPages(ctx context.Context, p pager, field idField, gte, lt int64, fields []string) ([]int64, []uint32, error) {
+	if len(fields) == 0 {
+		ids, err := fetchIDPages(ctx, p, field, gte, lt)
+		return ids, nil, err
+	}
+
+	req := createIDRequest(field, gte, lt)
+	req.ScriptFields = map[string]types.ScriptField{
+		"checksum": {
+			Script: types.InlineScript{
+				Source: checksumFunctions + "return checksum(params['_source'], params.fields);",
+				Params: checksumParams(fields),
+			},
+		},
+	}
+	ids := []int64{}
+	checksums := []uint32{}
+	err := fetchPages(ctx, p, req, func(res *searchResponse) error {
+		for _, hit := range res.Hits.Hits {
+			id, err := extractID(hit.Source, field)
+			if err != nil {
+				return err
+			}
+			values := hit.Fields["checksum"]
+			if len(values) != 1 {
+				return fmt.Errorf("No checksum returned for ID %d", id)
+			}
+			checksum, err := values[0].Int64()
+			if err != nil {
+				return err
+			}
+			ids = append(ids, id)
+			checksums = append(checksums, uint32(checksum))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return ids, checksums, nil
+}
+
+// fetchChecksumPages fetches the checksum of every record in a range, keyed by ID
+func fetchChecksumPages(ctx context.Context, p pager, field idField, gte, lt int64, fields []string) (map[int64]uint32, error) {
+	ids, sums, err := fetchDocPages(ctx, p, field, gte, lt, fields)
+	if err != nil {
+		return nil, err
+	}
+	checksums := make(map[int64]uint32, len(ids))
+	for i, id := range ids {
+		checksums[id] = sums[i]
+	}
+	return checksums, nil
+}
@@ -0,0 +1,56 @@
+package datasource
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	h "github.com/arturom/datadiff/histogram"
+)
+
+func TestElasticsearchChecksumsMatchAcrossDrivers(t *testing.T) {
+	docs := []map[string]interface{}{
+		{"id": int64(1), "name": "a", "meta": map[string]interface{}{"v": int64(7)}},
+		{"id": int64(2), "name": "b"},
+		{"id": int64(15), "name": "c", "meta": map[string]interface{}{"v": 8.5}},
+	}
+	f7, s7 := newTestES7(t)
+	f8, s8 := newTestES8(t)
+	fos, sos := newTestOpenSearch(t)
+	fields := []string{"name", "meta.v"}
+	s7.checksumFields, s8.checksumFields, sos.checksumFields = fields, fields, fields
+	for _, f := range []*fakeES{f7, f8, fos} {
+		f.add(docs...)
+	}
+
+	// The drivers render the fields with the same script, so identical documents have the same checksums
+	var histograms []h.Histogram
+	var checksums []map[int64]uint32
+	for _, s := range []DataSource{s7, s8, sos} {
+		c := s.(Checksummer)
+		if c.ChecksumEngine() != s7.ChecksumEngine() {
+			t.Errorf("got engine %s, want %s", c.ChecksumEngine(), s7.ChecksumEngine())
+		}
+		histogram, err := s.FetchHistogramRange(context.Background(), 0, 20, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		histograms = append(histograms, histogram)
+		records, err := c.FetchChecksumRange(context.Background(), 0, 20)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checksums = append(checksums, records)
+	}
+	for i := 1; i < len(histograms); i++ {
+		if !reflect.DeepEqual(histograms[i], histograms[0]) {
+			t.Errorf("got %v, want %v", histograms[i], histograms[0])
+		}
+		if !reflect.DeepEqual(checksums[i], checksums[0]) {
+			t.Errorf("got checksums %v, want %v", checksums[i], checksums[0])
+		}
+	}
+	if len(checksums[0]) != 3 || histograms[0].Bins[0].Checksum == 0 {
+		t.Errorf("got checksums %v and %v, want every document checksummed", checksums[0], histograms[0])
+	}
+}
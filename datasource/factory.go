@@ -1,18 +1,28 @@
 package datasource
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
+	"strings"
 
 	es7 "github.com/elastic/go-elasticsearch/v7"
 	es8 "github.com/elastic/go-elasticsearch/v8"
+	"github.com/opensearch-project/opensearch-go/v2"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	mongoOptions "go.mongodb.org/mongo-driver/mongo/options"
 	es0 "gopkg.in/olivere/elastic.v1"
 )
 
 // DataSourceFactory instantiates data sources
-type DataSourceFactory struct{}
+type DataSourceFactory struct {
+	// Unsigned makes every data source read unsigned 64-bit IDs, compared through their keys
+	Unsigned bool
+}
 
 // Create instantiates a data source based on the driver given
 func (f DataSourceFactory) Create(driver, cnxString, config string) (DataSource, error) {
@@ -20,6 +30,22 @@ func (f DataSourceFactory) Create(driver, cnxString, config string) (DataSource,
 		return f.mySQLSource(cnxString, config)
 	}
 
+	if driver == "postgres" {
+		return f.postgresSource(cnxString, config)
+	}
+
+	if driver == "sqlite" {
+		return f.sqliteSource(cnxString, config)
+	}
+
+	if driver == "file" {
+		return f.fileSource(cnxString, config)
+	}
+
+	if driver == "mongodb" {
+		return f.mongoSource(cnxString, config)
+	}
+
 	if driver == "es0" {
 		return f.elasticsearch0Source(cnxString, config)
 	}
@@ -32,18 +58,28 @@ func (f DataSourceFactory) Create(driver, cnxString, config string) (DataSource,
 		return f.elasticsearch8Source(cnxString, config)
 	}
 
+	if driver == "opensearch" {
+		return f.openSearchSource(cnxString, config)
+	}
+
+	if driver == "sharded" {
+		return f.shardedSource(cnxString, config)
+	}
+
 	return nil, fmt.Errorf("No datasource matching type: %s", driver)
 }
 
-type mySQLOpts struct {
+type sqlOpts struct {
 	TableName  string   `json:"table_name"`
 	FieldName  string   `json:"field_name"`
 	Conditions []string `json:"conditions"`
+	// ChecksumFields are the columns compared when checking records for modifications
+	ChecksumFields []string `json:"checksum_fields"`
 }
 
 func (f DataSourceFactory) mySQLSource(cnxString string, config string) (DataSource, error) {
 	// Unmarshal config String
-	c := mySQLOpts{}
+	c := sqlOpts{}
 	err := json.Unmarshal([]byte(config), &c)
 	if err != nil {
 		return nil, err
@@ -63,13 +99,156 @@ func (f DataSourceFactory) mySQLSource(cnxString string, config string) (DataSou
 
 	// Return instance of DataSource
 	return MysqlDataSource{
-		DB:         db,
-		Tablename:  c.TableName,
-		FieldName:  c.FieldName,
-		Conditions: c.Conditions,
+		DB:             db,
+		Tablename:      c.TableName,
+		FieldName:      c.FieldName,
+		Conditions:     c.Conditions,
+		ChecksumFields: c.ChecksumFields,
+		Unsigned:       f.Unsigned,
+	}, nil
+}
+
+func (f DataSourceFactory) postgresSource(cnxString string, config string) (DataSource, error) {
+	// Unmarshal config String
+	c := sqlOpts{}
+	err := json.Unmarshal([]byte(config), &c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Instantiate PostgreSQL connection pool
+	db, err := sql.Open("postgres", cnxString)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ping the PostgreSQL server
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	// Return instance of DataSource
+	return PostgresDataSource{
+		DB:             db,
+		Tablename:      c.TableName,
+		FieldName:      c.FieldName,
+		Conditions:     c.Conditions,
+		ChecksumFields: c.ChecksumFields,
+		Unsigned:       f.Unsigned,
+	}, nil
+}
+
+func (f DataSourceFactory) sqliteSource(cnxString string, config string) (DataSource, error) {
+	// SQLite integers are signed 64-bit
+	if f.Unsigned {
+		return nil, errUnsigned("sqlite")
+	}
+
+	// Unmarshal config String
+	c := sqlOpts{}
+	err := json.Unmarshal([]byte(config), &c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open the database file read-only so that a wrong path fails instead of creating a new file
+	if !strings.HasPrefix(cnxString, "file:") {
+		cnxString = "file:" + cnxString + "?mode=ro"
+	}
+	db, err := sql.Open(SqliteDriverName, cnxString)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open the database file
+	err = db.Ping()
+	if err != nil {
+		return nil, err
+	}
+
+	// Return instance of DataSource
+	return SqliteDataSource{
+		DB:             db,
+		Tablename:      c.TableName,
+		FieldName:      c.FieldName,
+		Conditions:     c.Conditions,
+		ChecksumFields: c.ChecksumFields,
 	}, nil
 }
 
+type fileOpts struct {
+	Format   string `json:"format"`
+	Column   string `json:"column"`
+	Header   bool   `json:"header"`
+	Field    string `json:"field"`
+	InMemory bool   `json:"in_memory"`
+}
+
+func (f DataSourceFactory) fileSource(cnxString string, config string) (DataSource, error) {
+	// Unmarshal config String
+	c := fileOpts{}
+	err := json.Unmarshal([]byte(config), &c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse and index the file, which is given as the connection string
+	return NewFileDataSource(cnxString, FileFormat{
+		Format:   c.Format,
+		Column:   c.Column,
+		Header:   c.Header,
+		Field:    c.Field,
+		Unsigned: f.Unsigned,
+	}, c.InMemory)
+}
+
+type mongoOpts struct {
+	Database   string          `json:"database"`
+	Collection string          `json:"collection"`
+	Field      string          `json:"field"`
+	Filter     json.RawMessage `json:"filter"`
+}
+
+func (f DataSourceFactory) mongoSource(cnxString string, config string) (DataSource, error) {
+	// BSON has no unsigned 64-bit integers
+	if f.Unsigned {
+		return nil, errUnsigned("mongodb")
+	}
+
+	// Unmarshal config String
+	c := mongoOpts{Field: "_id"}
+	err := json.Unmarshal([]byte(config), &c)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse the optional filter document, which may use extended JSON
+	filter := bson.D{}
+	if len(c.Filter) != 0 {
+		err = bson.UnmarshalExtJSON(c.Filter, false, &filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Instantiate a MongoDB client
+	client, err := mongo.Connect(context.Background(), mongoOptions.Client().ApplyURI(cnxString))
+	if err != nil {
+		return nil, err
+	}
+
+	// Ping the MongoDB server
+	err = client.Ping(context.Background(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Return instance of DataSource
+	collection := client.Database(c.Database).Collection(c.Collection)
+	return NewMongoDataSource(collection, c.Field, filter), nil
+}
+
 type es0Opts struct {
 	IndexName string `json:"index"`
 	TypeName  string `json:"type"`
@@ -77,6 +256,11 @@ type es0Opts struct {
 }
 
 func (f DataSourceFactory) elasticsearch0Source(cnxString string, config string) (DataSource, error) {
+	// Elasticsearch added unsigned_long in 7.10
+	if f.Unsigned {
+		return nil, errUnsigned("es0")
+	}
+
 	// Unmarshal config String
 	c := es0Opts{}
 	err := json.Unmarshal([]byte(config), &c)
@@ -103,6 +287,8 @@ func (f DataSourceFactory) elasticsearch0Source(cnxString string, config string)
 type es7Opts struct {
 	Index string `json:"index"`
 	Field string `json:"field"`
+	// ChecksumFields are the _source fields compared when checking records for modifications
+	ChecksumFields []string `json:"checksum_fields"`
 }
 
 func (f DataSourceFactory) elasticsearch7Source(cnxString string, config string) (DataSource, error) {
@@ -118,12 +304,55 @@ func (f DataSourceFactory) elasticsearch7Source(cnxString string, config string)
 		return nil, err
 	}
 
-	return NewElasticsearch7DataSource(client, opts.Index, opts.Field), nil
+	// Verify that the ID field is numeric
+	s := NewElasticsearch7DataSource(client, opts.Index, opts.Field)
+	s.checksumFields = opts.ChecksumFields
+	s.field.unsigned = f.Unsigned
+	err = s.validateField()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type openSearchOpts struct {
+	Index string `json:"index"`
+	Field string `json:"field"`
+	// ChecksumFields are the _source fields compared when checking records for modifications
+	ChecksumFields []string `json:"checksum_fields"`
+}
+
+func (f DataSourceFactory) openSearchSource(cnxString string, config string) (DataSource, error) {
+	opts := openSearchOpts{}
+	err := json.Unmarshal([]byte(config), &opts)
+	if err != nil {
+		return nil, err
+	}
+	client, err := opensearch.NewClient(opensearch.Config{
+		Addresses: []string{cnxString},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Verify that the ID field is numeric
+	s := NewOpenSearchDataSource(client, opts.Index, opts.Field)
+	s.checksumFields = opts.ChecksumFields
+	s.field.unsigned = f.Unsigned
+	err = s.validateField()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
 }
 
 type es8Opts struct {
 	Index string `json:"index"`
 	Field string `json:"field"`
+	// ChecksumFields are the _source fields compared when checking records for modifications
+	ChecksumFields []string `json:"checksum_fields"`
 }
 
 func (f DataSourceFactory) elasticsearch8Source(cnxString string, config string) (DataSource, error) {
@@ -140,5 +369,77 @@ func (f DataSourceFactory) elasticsearch8Source(cnxString string, config string)
 		return nil, err
 	}
 
-	return NewElasticsearch8DataSource(client, opts.Index, opts.Field), nil
+	// Verify that the ID field is numeric
+	s := NewElasticsearch8DataSource(client, opts.Index, opts.Field)
+	s.checksumFields = opts.ChecksumFields
+	s.field.unsigned = f.Unsigned
+	err = s.validateField()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type shardedOpts struct {
+	Shards []shardOpts `json:"shards"`
+	// Concurrency limits the number of shards queried at once, DefaultShardConcurrency when zero
+	Concurrency int `json:"concurrency"`
+}
+
+type shardOpts struct {
+	Driver string `json:"driver"`
+	// Conn defaults to the connection string of the sharded source
+	Conn string          `json:"conn"`
+	Conf json.RawMessage `json:"conf"`
+	// Gte and Lt optionally route the IDs in [gte, lt) to the shard
+	Gte *json.Number `json:"gte"`
+	Lt  *json.Number `json:"lt"`
+}
+
+func (f DataSourceFactory) shardedSource(cnxString string, config string) (DataSource, error) {
+	// Unmarshal config String
+	c := shardedOpts{}
+	err := json.Unmarshal([]byte(config), &c)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.Shards) == 0 {
+		return nil, fmt.Errorf("Sharded source has no shards")
+	}
+
+	// Instantiate every shard with its own driver
+	shards := make([]Shard, len(c.Shards))
+	for i, o := range c.Shards {
+		conn := o.Conn
+		if conn == "" {
+			conn = cnxString
+		}
+		conf := "{}"
+		if len(o.Conf) != 0 {
+			conf = string(o.Conf)
+		}
+		shards[i].Source, err = f.Create(o.Driver, conn, conf)
+		if err != nil {
+			return nil, fmt.Errorf("Shard %d: %v", i, err)
+		}
+		shards[i].Gte, shards[i].Lt = math.MinInt64, math.MaxInt64
+		if o.Gte != nil {
+			shards[i].Gte, err = ParseID(o.Gte.String(), f.Unsigned)
+			if err != nil {
+				return nil, fmt.Errorf("Shard %d: invalid gte: %v", i, err)
+			}
+		}
+		if o.Lt != nil {
+			shards[i].Lt, err = ParseID(o.Lt.String(), f.Unsigned)
+			if err != nil {
+				return nil, fmt.Errorf("Shard %d: invalid lt: %v", i, err)
+			}
+		}
+		if shards[i].Gte >= shards[i].Lt {
+			return nil, fmt.Errorf("Shard %d has an empty range", i)
+		}
+	}
+
+	return NewShardedDataSource(shards, c.Concurrency), nil
 }
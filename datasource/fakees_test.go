@@ -0,0 +1,526 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeES serves the parts of the Elasticsearch and OpenSearch search API used by the data sources from
+// documents held in memory. Histograms are computed with doubles and include empty buckets unless
+// min_doc_count is set, and search_after skips documents sorting equal to the last hit, like Elasticsearch.
+// The checksum scripts are answered with the CRC32 of the checksum fields they are given, and the bin script
+// with the bin it keys an ID with, both computed in Go.
+// Documents are given their position as _id unless a bulk request indexes them under another, and are deleted
+// by the terms query of a delete by query.
+// Points in time are searched like the index, which must then be left out of the path.
+// IDs are compared through their keys, so that an unsigned_long field holding uint64 IDs sorts like Elasticsearch.
+type fakeES struct {
+	index string
+	field string
+	// mapping is the type the ID field is mapped as
+	mapping string
+	// unsigned is set when the ID field holds uint64 IDs
+	unsigned bool
+
+	mu       sync.Mutex
+	docs     []map[string]interface{}
+	docIDs   []string
+	requests []map[string]interface{}
+	// pits counts the points in time opened, and openPits those not closed yet
+	pits     int
+	openPits int
+}
+
+// newFakeES starts a fake cluster holding an index of documents with the given IDs in the ID field
+func newFakeES(t *testing.T, index, field string, ids ...int64) (*fakeES, *httptest.Server) {
+	f := &fakeES{index: index, field: field, mapping: "long"}
+	for _, id := range ids {
+		f.add(map[string]interface{}{field: id})
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// newUnsignedFakeES starts a fake cluster holding an index of documents with the given IDs in an unsigned_long ID field
+func newUnsignedFakeES(t *testing.T, index, field string, ids ...uint64) (*fakeES, *httptest.Server) {
+	f := &fakeES{index: index, field: field, mapping: "unsigned_long", unsigned: true}
+	for _, id := range ids {
+		f.add(map[string]interface{}{field: id})
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// key returns the key of an ID, held as an int64 or a uint64 in documents and as a number in requests
+func (f *fakeES) key(v interface{}) int64 {
+	switch v := v.(type) {
+	case uint64:
+		return UnsignedKey(v)
+	case json.Number:
+		key, _ := ParseID(v.String(), f.unsigned)
+		return key
+	}
+	return v.(int64)
+}
+
+func (f *fakeES) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Elastic-Product", "Elasticsearch")
+	w.Header().Set("Content-Type", "application/json")
+	var res interface{}
+	var err error
+	switch {
+	case r.URL.Path == "/"+f.index+"/_search":
+		res, err = f.search(r.Body, false)
+	case r.URL.Path == "/_search":
+		res, err = f.search(r.Body, true)
+	case r.URL.Path == "/"+f.index+"/_pit" && r.Method == http.MethodPost:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.pits++
+		f.openPits++
+		res = map[string]interface{}{"id": fmt.Sprint("pit-", f.pits)}
+	case r.URL.Path == "/_pit" && r.Method == http.MethodDelete:
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.openPits--
+		res = map[string]interface{}{"succeeded": true, "num_freed": 1}
+	case r.URL.Path == "/_bulk":
+		res, err = f.bulk(r.Body)
+	case r.URL.Path == "/"+f.index+"/_delete_by_query":
+		res, err = f.deleteByQuery(r.Body)
+	case strings.HasPrefix(r.URL.Path, "/"+f.index+"/_mapping/field/"):
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		// An unmapped field is left out of the mappings
+		mappings := map[string]interface{}{}
+		if f.mapping != "" {
+			mappings[f.field] = map[string]interface{}{
+				"mapping": map[string]interface{}{
+					f.field: map[string]string{"type": f.mapping},
+				},
+			}
+		}
+		res = map[string]interface{}{
+			f.index: map[string]interface{}{"mappings": mappings},
+		}
+	default:
+		err = fmt.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		res = map[string]interface{}{"error": err.Error()}
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// add indexes documents, which must hold an int64 in the ID field, or a uint64 when unsigned
+func (f *fakeES) add(docs ...map[string]interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, d := range docs {
+		f.docIDs = append(f.docIDs, fmt.Sprint(len(f.docs)))
+		f.docs = append(f.docs, d)
+	}
+}
+
+// indexed returns the documents by _id
+func (f *fakeES) indexed() map[string]map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	docs := make(map[string]map[string]interface{}, len(f.docs))
+	for i, d := range f.docs {
+		docs[f.docIDs[i]] = d
+	}
+	return docs
+}
+
+// mapAs changes the type the ID field is mapped as, leaving it unmapped when empty
+func (f *fakeES) mapAs(mapping string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mapping = mapping
+}
+
+// searched returns the bodies of the search requests received so far
+func (f *fakeES) searched() []map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]map[string]interface{}(nil), f.requests...)
+}
+
+type fakeHit struct {
+	doc    int
+	source map[string]interface{}
+	// sort holds the keys the hit sorts on, and values the sort values returned for them
+	sort   []int64
+	values []interface{}
+}
+
+// search answers a search of the index, or of a point in time of it when pit is set
+func (f *fakeES) search(body io.Reader, pit bool) (interface{}, error) {
+	req := make(map[string]interface{})
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	err := dec.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	if _, ok := req["pit"]; ok != pit {
+		return nil, fmt.Errorf("point in time searched with the index in the path %t", !pit)
+	}
+
+	gte, lt := int64(math.MinInt64), int64(math.MaxInt64)
+	var terms map[int64]bool
+	if q, ok := req["query"].(map[string]interface{}); ok {
+		if r, ok := q["range"].(map[string]interface{}); ok {
+			bounds := r[f.field].(map[string]interface{})
+			gte, lt = f.key(bounds["gte"]), f.key(bounds["lt"])
+		} else {
+			terms = make(map[int64]bool)
+			for _, v := range asSlice(q["terms"].(map[string]interface{})[f.field]) {
+				terms[f.key(v)] = true
+			}
+		}
+	}
+	var matched []fakeHit
+	for i, d := range f.docs {
+		id := f.key(d[f.field])
+		if id >= gte && id < lt && (terms == nil || terms[id]) {
+			matched = append(matched, fakeHit{doc: i, source: d})
+		}
+	}
+
+	res := map[string]interface{}{"took": 1, "timed_out": false}
+	if pit {
+		res["pit_id"] = req["pit"].(map[string]interface{})["id"]
+	}
+	if aggs, ok := req["aggregations"].(map[string]interface{}); ok {
+		ids := aggs["ids"].(map[string]interface{})
+		var h map[string]interface{}
+		if _, ok := ids["composite"]; ok {
+			h = f.composite(ids, matched)
+		} else {
+			h, err = f.histogram(ids, matched)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res["aggregations"] = map[string]interface{}{"ids": h}
+	}
+
+	// Sort on the fields requested, reading _doc, _shard_doc and _id as the index order
+	var fields []string
+	for _, s := range asSlice(req["sort"]) {
+		if name, ok := s.(string); ok {
+			fields = append(fields, name)
+			continue
+		}
+		for name := range s.(map[string]interface{}) {
+			fields = append(fields, name)
+		}
+	}
+	for i := range matched {
+		for _, name := range fields {
+			if name == "_doc" || name == "_shard_doc" || name == "_id" {
+				matched[i].sort = append(matched[i].sort, int64(matched[i].doc))
+				matched[i].values = append(matched[i].values, matched[i].doc)
+			} else {
+				matched[i].sort = append(matched[i].sort, f.key(matched[i].source[name]))
+				matched[i].values = append(matched[i].values, matched[i].source[name])
+			}
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return compareSort(matched[i].sort, matched[j].sort) < 0
+	})
+	if after := asSlice(req["search_after"]); len(after) != 0 {
+		key := make([]int64, len(after))
+		for i, v := range after {
+			if fields[i] == f.field {
+				key[i] = f.key(v)
+			} else {
+				key[i], _ = v.(json.Number).Int64()
+			}
+		}
+		n := sort.Search(len(matched), func(i int) bool {
+			return compareSort(matched[i].sort, key) > 0
+		})
+		matched = matched[n:]
+	}
+
+	size := 10
+	if s, ok := req["size"].(json.Number); ok {
+		n, _ := s.Int64()
+		size = int(n)
+	}
+	hits := []map[string]interface{}{}
+	for _, m := range matched[:min(size, len(matched))] {
+		hit := map[string]interface{}{
+			"_index":  f.index,
+			"_id":     f.docIDs[m.doc],
+			"_source": m.source,
+		}
+		if len(fields) != 0 {
+			hit["sort"] = m.values
+		}
+		if scripts, ok := req["script_fields"].(map[string]interface{}); ok {
+			params := scripts["checksum"].(map[string]interface{})["script"].(map[string]interface{})["params"]
+			hit["fields"] = map[string]interface{}{"checksum": []uint32{fakeChecksum(m.source, params)}}
+		}
+		hits = append(hits, hit)
+	}
+	res["hits"] = map[string]interface{}{"hits": hits}
+	return res, nil
+}
+
+// bulk indexes documents, replacing those with the same _id
+func (f *fakeES) bulk(body io.Reader) (interface{}, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	var items []map[string]interface{}
+	for dec.More() {
+		var action map[string]struct {
+			Index string `json:"_index"`
+			ID    string `json:"_id"`
+		}
+		var doc map[string]interface{}
+		err := dec.Decode(&action)
+		if err == nil {
+			err = dec.Decode(&doc)
+		}
+		if err != nil {
+			return nil, err
+		}
+		meta, ok := action["index"]
+		if !ok || meta.Index != f.index {
+			return nil, fmt.Errorf("unexpected bulk action %v", action)
+		}
+		if f.unsigned {
+			doc[f.field], err = strconv.ParseUint(doc[f.field].(json.Number).String(), 10, 64)
+		} else {
+			doc[f.field], err = doc[f.field].(json.Number).Int64()
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		replaced := false
+		for i, id := range f.docIDs {
+			if id == meta.ID {
+				f.docs[i] = doc
+				replaced = true
+			}
+		}
+		if !replaced {
+			f.docIDs = append(f.docIDs, meta.ID)
+			f.docs = append(f.docs, doc)
+		}
+		items = append(items, map[string]interface{}{"index": map[string]interface{}{"_id": meta.ID, "status": 200}})
+	}
+	return map[string]interface{}{"errors": false, "items": items}, nil
+}
+
+// deleteByQuery deletes the documents whose ID is one of the terms of the query
+func (f *fakeES) deleteByQuery(body io.Reader) (interface{}, error) {
+	req := make(map[string]interface{})
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	err := dec.Decode(&req)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	terms := make(map[int64]bool)
+	for _, v := range asSlice(req["query"].(map[string]interface{})["terms"].(map[string]interface{})[f.field]) {
+		terms[f.key(v)] = true
+	}
+	deleted := 0
+	for i := 0; i < len(f.docs); i++ {
+		if terms[f.key(f.docs[i][f.field])] {
+			f.docs = append(f.docs[:i], f.docs[i+1:]...)
+			f.docIDs = append(f.docIDs[:i], f.docIDs[i+1:]...)
+			i--
+			deleted++
+		}
+	}
+	return map[string]interface{}{"deleted": deleted, "failures": []interface{}{}}, nil
+}
+
+// histogram buckets the hits on doubles like Elasticsearch, which rounds IDs past 2^53
+func (f *fakeES) histogram(ids map[string]interface{}, hits []fakeHit) (map[string]interface{}, error) {
+	agg := ids["histogram"].(map[string]interface{})
+	interval, _ := agg["interval"].(json.Number).Float64()
+	var offset float64
+	if o, ok := agg["offset"].(json.Number); ok {
+		offset, _ = o.Float64()
+	}
+	var minDocCount int64
+	if m, ok := agg["min_doc_count"].(json.Number); ok {
+		minDocCount, _ = m.Int64()
+	}
+	var checksumParams interface{}
+	if sub, ok := ids["aggregations"].(map[string]interface{}); ok {
+		checksumParams = sub["checksum"].(map[string]interface{})["scripted_metric"].(map[string]interface{})["params"]
+	}
+	counts := make(map[float64]int64)
+	checksums := make(map[float64]uint32)
+	for _, hit := range hits {
+		key := math.Floor((float64(hit.source[f.field].(int64))-offset)/interval)*interval + offset
+		counts[key]++
+		if checksumParams != nil {
+			checksums[key] ^= fakeChecksum(hit.source, checksumParams)
+		}
+	}
+	bucket := func(k float64) map[string]interface{} {
+		b := map[string]interface{}{"key": k, "doc_count": counts[k]}
+		if checksumParams != nil {
+			b["checksum"] = map[string]interface{}{"value": checksums[k]}
+		}
+		return b
+	}
+	var keys []float64
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+	buckets := []map[string]interface{}{}
+	if len(keys) != 0 && minDocCount == 0 {
+		// Every bucket between the first and the last is returned, even empty
+		if (keys[len(keys)-1]-keys[0])/interval > fakeMaxBuckets {
+			return nil, fmt.Errorf("too_many_buckets_exception")
+		}
+		for k := keys[0]; k <= keys[len(keys)-1]; k += interval {
+			buckets = append(buckets, bucket(k))
+		}
+	}
+	for _, k := range keys {
+		if minDocCount != 0 && counts[k] >= minDocCount {
+			buckets = append(buckets, bucket(k))
+		}
+	}
+	return map[string]interface{}{"buckets": buckets}, nil
+}
+
+// composite buckets the hits by the bins the bin script keys them with, computed in Go from its params,
+// returning a page of the buckets sorted by key past the after key
+func (f *fakeES) composite(ids map[string]interface{}, hits []fakeHit) map[string]interface{} {
+	agg := ids["composite"].(map[string]interface{})
+	terms := asSlice(agg["sources"])[0].(map[string]interface{})["bin"].(map[string]interface{})["terms"].(map[string]interface{})
+	params := terms["script"].(map[string]interface{})["params"].(map[string]interface{})
+	param := func(name string) int64 {
+		n, _ := params[name].(json.Number).Int64()
+		return n
+	}
+	first, next, interval := param("first"), param("next"), param("interval")
+	var checksumParams interface{}
+	if sub, ok := ids["aggregations"].(map[string]interface{}); ok {
+		checksumParams = sub["checksum"].(map[string]interface{})["scripted_metric"].(map[string]interface{})["params"]
+	}
+
+	counts := make(map[int64]int64)
+	checksums := make(map[int64]uint32)
+	for _, hit := range hits {
+		// Scripts read unsigned_long values as the bits of a long
+		var id int64
+		switch v := hit.source[params["field"].(string)].(type) {
+		case uint64:
+			id = int64(v)
+		default:
+			id = v.(int64)
+		}
+		if params["unsigned"] == true {
+			id ^= math.MinInt64
+		}
+		key := first
+		if id >= next {
+			key = id - (id-next)%interval
+		}
+		counts[key]++
+		if checksumParams != nil {
+			checksums[key] ^= fakeChecksum(hit.source, checksumParams)
+		}
+	}
+	var keys []int64
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i] < keys[j]
+	})
+	if after, ok := agg["after"].(map[string]interface{}); ok {
+		a, _ := after["bin"].(json.Number).Int64()
+		keys = keys[sort.Search(len(keys), func(i int) bool {
+			return keys[i] > a
+		}):]
+	}
+	size, _ := agg["size"].(json.Number).Int64()
+	keys = keys[:min(int(size), len(keys))]
+
+	buckets := []map[string]interface{}{}
+	for _, k := range keys {
+		b := map[string]interface{}{"key": map[string]int64{"bin": k}, "doc_count": counts[k]}
+		if checksumParams != nil {
+			b["checksum"] = map[string]interface{}{"value": checksums[k]}
+		}
+		buckets = append(buckets, b)
+	}
+	res := map[string]interface{}{"buckets": buckets}
+	if len(keys) != 0 {
+		res["after_key"] = map[string]int64{"bin": keys[len(keys)-1]}
+	}
+	return res
+}
+
+// fakeChecksum computes what the checksum script returns for a document, skipping missing fields
+func fakeChecksum(source map[string]interface{}, params interface{}) uint32 {
+	var values []string
+	for _, field := range asSlice(params.(map[string]interface{})["fields"]) {
+		var v interface{} = source
+		for _, key := range strings.Split(field.(string), ".") {
+			m, _ := v.(map[string]interface{})
+			v = m[key]
+		}
+		if v != nil {
+			values = append(values, fmt.Sprint(v))
+		}
+	}
+	return crc32.ChecksumIEEE([]byte(strings.Join(values, "|")))
+}
+
+// fakeMaxBuckets stands for the search.max_buckets setting
+const fakeMaxBuckets = 65536
+
+func asSlice(v interface{}) []interface{} {
+	s, _ := v.([]interface{})
+	return s
+}
+
+func compareSort(a, b []int64) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
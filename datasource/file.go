@@ -0,0 +1,328 @@
+package datasource
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/arturom/datadiff/histogram"
+)
+
+// FileDataSource implements the datasource interface over a local dump of IDs.
+// The IDs are parsed once and kept in a sorted index, so every query is a binary search followed by a scan.
+type FileDataSource struct {
+	ids sortedIDs
+}
+
+// FileFormat describes how IDs are laid out in a file
+type FileFormat struct {
+	// Format is one of text, csv or jsonl
+	Format string
+	// Column is the CSV column holding the ID, by header name or by zero-based index
+	Column string
+	// Header indicates that the first CSV row holds column names
+	Header bool
+	// Field is the dot-separated path to the ID in each JSONL object
+	Field string
+	// Unsigned reads the IDs as unsigned 64-bit integers, indexed by their keys
+	Unsigned bool
+}
+
+// NewFileDataSource parses a text, CSV or JSONL file, optionally gzip-compressed, and indexes its IDs.
+// Unless inMemory is set, the index is sorted on disk so that files larger than memory can be used.
+func NewFileDataSource(path string, format FileFormat, inMemory bool) (*FileDataSource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := decompress(f)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := newIDReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids sortedIDs
+	if inMemory {
+		ids, err = sortInMemory(next)
+	} else {
+		ids, err = sortOnDisk(next)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileDataSource{ids: ids}, nil
+}
+
+func (s FileDataSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	return s.histogram(ctx, 0, s.ids.Len(), 0, interval)
+}
+
+func (s FileDataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	from, to, err := s.bounds(gte, lt)
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+	return s.histogram(ctx, from, to, gte, interval)
+}
+
+func (s FileDataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	from, to, err := s.bounds(gte, lt)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int64, 0, to-from)
+	err = s.ids.Scan(ctx, from, to, func(id int64) {
+		ids = append(ids, id)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// bounds returns the positions of the first ID >= gte and the first ID >= lt
+func (s FileDataSource) bounds(gte, lt int64) (int64, int64, error) {
+	from, err := lowerBound(s.ids, gte)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := lowerBound(s.ids, lt)
+	if err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+// histogram counts the IDs between two positions, which arrive sorted and therefore bin by bin, in bins starting at origin
+func (s FileDataSource) histogram(ctx context.Context, from, to, origin, interval int64) (histogram.Histogram, error) {
+	bins := make(histogram.Bins, 0)
+	err := s.ids.Scan(ctx, from, to, func(id int64) {
+		key := binStart(id, origin, interval)
+		if len(bins) == 0 || bins[len(bins)-1].Key != key {
+			bins = append(bins, histogram.Bin{Key: key})
+		}
+		bins[len(bins)-1].Count++
+	})
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+	return histogram.Histogram{
+		BinCapacity: interval,
+		Bins:        bins,
+	}, nil
+}
+
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// binStart returns the key of the bin holding an ID, with bins of the interval laid out from origin.
+// IDs are offset from the origin without overflowing, however far they are from it, and the bin holding
+// the smallest IDs starts at the smallest ID when it would start before it.
+func binStart(id, origin, interval int64) int64 {
+	if id >= origin {
+		return origin + int64((uint64(id)-uint64(origin))/uint64(interval)*uint64(interval))
+	}
+	back := (uint64(origin)-uint64(id)-1)/uint64(interval) + 1
+	if back > (uint64(origin)+1<<63)/uint64(interval) {
+		return math.MinInt64
+	}
+	return int64(uint64(origin) - back*uint64(interval))
+}
+
+// nextBinStart returns the first bin start at or past gte, with bins laid out from origin,
+// or math.MaxInt64 when the bin holding gte is the last one
+func nextBinStart(gte, origin, interval int64) int64 {
+	if gte < origin {
+		return int64(uint64(gte) + (uint64(origin)-uint64(gte))%uint64(interval))
+	}
+	key := binStart(gte, origin, interval)
+	if key == gte {
+		return key
+	}
+	if key > math.MaxInt64-interval {
+		return math.MaxInt64
+	}
+	return key + interval
+}
+
+// decompress transparently unwraps gzip input, detected by its magic number
+func decompress(r io.Reader) (io.Reader, error) {
+	buf := bufio.NewReader(r)
+	magic, err := buf.Peek(2)
+	if err == io.EOF {
+		return buf, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(buf)
+	}
+	return buf, nil
+}
+
+// idReader returns the next ID in a file, or io.EOF once the file is exhausted
+type idReader func() (int64, error)
+
+func newIDReader(r io.Reader, format FileFormat) (idReader, error) {
+	if format.Format == "" || format.Format == "text" {
+		return textIDReader(r, format.Unsigned), nil
+	}
+
+	if format.Format == "csv" {
+		return csvIDReader(r, format.Column, format.Header, format.Unsigned)
+	}
+
+	if format.Format == "jsonl" {
+		return jsonlIDReader(r, format.Field, format.Unsigned)
+	}
+
+	return nil, fmt.Errorf("No file reader matching format: %s", format.Format)
+}
+
+// textIDReader reads one ID per line, skipping blank lines
+func textIDReader(r io.Reader, unsigned bool) idReader {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	return func() (int64, error) {
+		for scanner.Scan() {
+			line++
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" {
+				continue
+			}
+			id, err := ParseID(text, unsigned)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid ID on line %d: %w", line, err)
+			}
+			return id, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+}
+
+// csvIDReader reads the IDs in one column. The column is found by name in the header row,
+// or taken as a zero-based index when it is numeric.
+func csvIDReader(r io.Reader, column string, header, unsigned bool) (idReader, error) {
+	c := csv.NewReader(r)
+	c.ReuseRecord = true
+
+	index, err := strconv.Atoi(column)
+	if err != nil {
+		header = true
+		index = -1
+	}
+	if header {
+		names, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		for i, name := range names {
+			if index < 0 && name == column {
+				index = i
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("Column %s not found in CSV header", column)
+		}
+	}
+
+	return func() (int64, error) {
+		record, err := c.Read()
+		if err != nil {
+			return 0, err
+		}
+		if index >= len(record) {
+			line, _ := c.FieldPos(0)
+			return 0, fmt.Errorf("Missing column %d on line %d", index, line)
+		}
+		id, err := ParseID(strings.TrimSpace(record[index]), unsigned)
+		if err != nil {
+			line, _ := c.FieldPos(index)
+			return 0, fmt.Errorf("Invalid ID on line %d: %w", line, err)
+		}
+		return id, nil
+	}, nil
+}
+
+// jsonlIDReader reads the ID at a dot-separated path in every JSON object, as a number or a numeric string
+func jsonlIDReader(r io.Reader, field string, unsigned bool) (idReader, error) {
+	if field == "" {
+		return nil, fmt.Errorf("A field path is required for jsonl files")
+	}
+	path := strings.Split(field, ".")
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+
+	return func() (int64, error) {
+		for scanner.Scan() {
+			line++
+			raw := bytes.TrimSpace(scanner.Bytes())
+			if len(raw) == 0 {
+				continue
+			}
+			id, err := extractJSONID(raw, path, unsigned)
+			if err != nil {
+				return 0, fmt.Errorf("Invalid ID on line %d: %w", line, err)
+			}
+			return id, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}, nil
+}
+
+func extractJSONID(raw json.RawMessage, path []string, unsigned bool) (int64, error) {
+	for _, key := range path {
+		obj := make(map[string]json.RawMessage)
+		err := json.Unmarshal(raw, &obj)
+		if err != nil {
+			return 0, err
+		}
+		v, ok := obj[key]
+		if !ok {
+			return 0, fmt.Errorf("Missing field %s", key)
+		}
+		raw = v
+	}
+
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return ParseID(s, unsigned)
+	}
+	var n json.Number
+	err := json.Unmarshal(raw, &n)
+	if err != nil {
+		return 0, err
+	}
+	return ParseID(n.String(), unsigned)
+}
+
+var _ DataSource = (*FileDataSource)(nil)
@@ -0,0 +1,315 @@
+package datasource
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"sort"
+)
+
+// chunkSize is the number of IDs sorted in memory at once when building an index on disk
+const chunkSize = 1 << 20
+
+// mergeFanIn is the number of chunks merged at once. More chunks are merged in several passes,
+// which bounds the open files and read buffers however large the file is.
+const mergeFanIn = 64
+
+// scanBufferSize is the number of IDs read from an index per call while scanning
+const scanBufferSize = 1 << 14
+
+// sortedIDs is an ascending sequence of IDs that can be accessed by position
+type sortedIDs interface {
+	Len() int64
+	At(i int64) (int64, error)
+	// Scan calls f with every ID at positions [from, to)
+	Scan(ctx context.Context, from, to int64, f func(id int64)) error
+}
+
+// lowerBound returns the position of the first ID that is not less than the given ID
+func lowerBound(ids sortedIDs, id int64) (int64, error) {
+	lo, hi := int64(0), ids.Len()
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		v, err := ids.At(mid)
+		if err != nil {
+			return 0, err
+		}
+		if v < id {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// memoryIDs keeps all the IDs in a sorted slice
+type memoryIDs []int64
+
+func sortInMemory(next idReader) (memoryIDs, error) {
+	ids := memoryIDs{}
+	for {
+		id, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+func (m memoryIDs) Len() int64 {
+	return int64(len(m))
+}
+
+func (m memoryIDs) At(i int64) (int64, error) {
+	return m[i], nil
+}
+
+func (m memoryIDs) Scan(ctx context.Context, from, to int64, f func(id int64)) error {
+	for i := from; i < to; i++ {
+		if i%scanBufferSize == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		f(m[i])
+	}
+	return nil
+}
+
+// fileIDs reads sorted IDs stored as fixed-width little-endian integers in a file
+type fileIDs struct {
+	f   *os.File
+	len int64
+}
+
+// sortOnDisk sorts IDs in chunks that fit in memory and merges the chunks into a single index file
+func sortOnDisk(next idReader) (*fileIDs, error) {
+	return sortChunks(next, chunkSize, mergeFanIn)
+}
+
+// sortChunks sorts IDs in chunks of the given size, then merges at most fanIn chunks at once
+// until they fit in a single merge into the index file
+func sortChunks(next idReader, size, fanIn int) (*fileIDs, error) {
+	var chunks []*os.File
+	defer func() {
+		removeChunks(chunks)
+	}()
+
+	chunk := make([]int64, 0, size)
+	for done := false; !done; {
+		id, err := next()
+		if err == io.EOF {
+			done = true
+		} else if err != nil {
+			return nil, err
+		} else {
+			chunk = append(chunk, id)
+		}
+
+		if len(chunk) == size || (done && len(chunk) > 0) {
+			c, err := writeChunk(chunk)
+			if err != nil {
+				return nil, err
+			}
+			chunks = append(chunks, c)
+			chunk = chunk[:0]
+		}
+	}
+
+	for len(chunks) > fanIn {
+		merged, err := mergePass(chunks, fanIn)
+		if err != nil {
+			return nil, err
+		}
+		chunks = merged
+	}
+
+	f, err := os.CreateTemp("", "datadiff-index-*")
+	if err != nil {
+		return nil, err
+	}
+	// The index is only reachable through the open handle and is reclaimed when the process exits
+	os.Remove(f.Name())
+
+	count, err := mergeChunks(chunks, f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &fileIDs{f: f, len: count}, nil
+}
+
+// mergePass merges every run of fanIn chunks into a new chunk, removing the chunks it merged
+func mergePass(chunks []*os.File, fanIn int) ([]*os.File, error) {
+	var merged []*os.File
+	for i := 0; i < len(chunks); i += fanIn {
+		group := chunks[i:min(i+fanIn, len(chunks))]
+		c, err := os.CreateTemp("", "datadiff-chunk-*")
+		if err != nil {
+			removeChunks(merged)
+			return nil, err
+		}
+		merged = append(merged, c)
+
+		_, err = mergeChunks(group, c)
+		if err == nil {
+			_, err = c.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			removeChunks(merged)
+			return nil, err
+		}
+		removeChunks(group)
+	}
+	return merged, nil
+}
+
+// removeChunks closes and deletes chunk files, ignoring those already removed
+func removeChunks(chunks []*os.File) {
+	for _, c := range chunks {
+		c.Close()
+		os.Remove(c.Name())
+	}
+}
+
+func writeChunk(ids []int64) (*os.File, error) {
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	f, err := os.CreateTemp("", "datadiff-chunk-*")
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	for _, id := range ids {
+		err = writeID(w, id)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// chunkHead holds the smallest unmerged ID of a chunk
+type chunkHead struct {
+	id int64
+	r  *bufio.Reader
+}
+
+type chunkHeap []chunkHead
+
+func (h chunkHeap) Len() int           { return len(h) }
+func (h chunkHeap) Less(i, j int) bool { return h[i].id < h[j].id }
+func (h chunkHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *chunkHeap) Push(x any)        { *h = append(*h, x.(chunkHead)) }
+func (h *chunkHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeChunks writes the IDs of sorted chunks to a file in order and returns how many were written
+func mergeChunks(chunks []*os.File, f *os.File) (int64, error) {
+	h := &chunkHeap{}
+	for _, c := range chunks {
+		r := bufio.NewReader(c)
+		id, err := readID(r)
+		if err != nil {
+			return 0, err
+		}
+		*h = append(*h, chunkHead{id: id, r: r})
+	}
+	heap.Init(h)
+
+	w := bufio.NewWriter(f)
+	count := int64(0)
+	for h.Len() > 0 {
+		head := &(*h)[0]
+		err := writeID(w, head.id)
+		if err != nil {
+			return 0, err
+		}
+		count++
+
+		head.id, err = readID(head.r)
+		if err == io.EOF {
+			heap.Pop(h)
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		heap.Fix(h, 0)
+	}
+	return count, w.Flush()
+}
+
+func writeID(w io.Writer, id int64) error {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(id))
+	_, err := w.Write(b[:])
+	return err
+}
+
+func readID(r io.Reader) (int64, error) {
+	var b [8]byte
+	_, err := io.ReadFull(r, b[:])
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b[:])), nil
+}
+
+func (s *fileIDs) Len() int64 {
+	return s.len
+}
+
+func (s *fileIDs) At(i int64) (int64, error) {
+	var b [8]byte
+	_, err := s.f.ReadAt(b[:], i*8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(binary.LittleEndian.Uint64(b[:])), nil
+}
+
+func (s *fileIDs) Scan(ctx context.Context, from, to int64, f func(id int64)) error {
+	buf := make([]byte, scanBufferSize*8)
+	for from < to {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		n := min(to-from, scanBufferSize)
+		_, err = s.f.ReadAt(buf[:n*8], from*8)
+		if err != nil {
+			return err
+		}
+		for i := int64(0); i < n; i++ {
+			f(int64(binary.LittleEndian.Uint64(buf[i*8:])))
+		}
+		from += n
+	}
+	return nil
+}
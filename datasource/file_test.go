@@ -0,0 +1,230 @@
+package datasource
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/arturom/datadiff/histogram"
+)
+
+// readAll drains an ID reader
+func readAll(next idReader) ([]int64, error) {
+	var ids []int64
+	for {
+		id, err := next()
+		if err == io.EOF {
+			return ids, nil
+		}
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+}
+
+func TestIDReaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		format FileFormat
+		input  string
+		want   []int64
+	}{
+		{"text", FileFormat{}, "3\n\n  -1 \n9223372036854775807\n", []int64{3, -1, 9223372036854775807}},
+		{"csv by name", FileFormat{Format: "csv", Column: "id"}, "name,id\na,5\nb, 7\n", []int64{5, 7}},
+		{"csv by index", FileFormat{Format: "csv", Column: "1"}, "a,5\nb,7\n", []int64{5, 7}},
+		{"csv by index with header", FileFormat{Format: "csv", Column: "0", Header: true}, "id\n5\n7\n", []int64{5, 7}},
+		{"jsonl", FileFormat{Format: "jsonl", Field: "order.id"}, `{"order":{"id":5}}` + "\n\n" + `{"order":{"id":"-7"}}` + "\n", []int64{5, -7}},
+		// Unsigned IDs are read as their keys, 2^63 being the key 0
+		{"unsigned text", FileFormat{Unsigned: true}, "0\n9223372036854775808\n18446744073709551615\n", []int64{-9223372036854775808, 0, 9223372036854775807}},
+		{"unsigned csv", FileFormat{Format: "csv", Column: "id", Unsigned: true}, "id\n9223372036854775809\n", []int64{1}},
+		{"unsigned jsonl", FileFormat{Format: "jsonl", Field: "id", Unsigned: true}, `{"id":18446744073709551614}` + "\n" + `{"id":"5"}` + "\n", []int64{9223372036854775806, -9223372036854775803}},
+	}
+	for _, tt := range tests {
+		next, err := newIDReader(strings.NewReader(tt.input), tt.format)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		got, err := readAll(next)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestIDReaderErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format FileFormat
+		input  string
+		want   string
+	}{
+		{"text", FileFormat{Format: "text"}, "1\n\nx\n", "Invalid ID on line 3"},
+		{"csv", FileFormat{Format: "csv", Column: "id"}, "id\n1\n2.5\n", "Invalid ID on line 3"},
+		{"csv column", FileFormat{Format: "csv", Column: "2"}, "1,2\n3,4\n", "Missing column 2 on line 1"},
+		{"csv header", FileFormat{Format: "csv", Column: "id"}, "name\n", "Column id not found in CSV header"},
+		{"jsonl", FileFormat{Format: "jsonl", Field: "id"}, `{"id":1}` + "\n" + `{"other":2}` + "\n", "Invalid ID on line 2: Missing field id"},
+		{"jsonl field", FileFormat{Format: "jsonl"}, "", "A field path is required"},
+		{"format", FileFormat{Format: "xml"}, "", "No file reader matching format: xml"},
+		{"unsigned", FileFormat{Unsigned: true}, "1\n-1\n", "Invalid ID on line 2"},
+		{"signed", FileFormat{}, "9223372036854775808\n", "Invalid ID on line 1"},
+	}
+	for _, tt := range tests {
+		next, err := newIDReader(strings.NewReader(tt.input), tt.format)
+		if err == nil {
+			_, err = readAll(next)
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got error %v, want %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+func TestNewFileDataSourceSniffsGzip(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "ids.txt")
+	err := os.WriteFile(plain, []byte("5\n1\n3\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := filepath.Join(dir, "ids.dump")
+	f, err := os.Create(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := gzip.NewWriter(f)
+	io.WriteString(w, "5\n1\n3\n")
+	w.Close()
+	f.Close()
+	empty := filepath.Join(dir, "empty.txt")
+	err = os.WriteFile(empty, nil, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{plain, compressed, empty} {
+		s, err := NewFileDataSource(path, FileFormat{}, true)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		got, err := s.FetchIDRange(context.Background(), 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []int64{1, 3, 5}
+		if path == empty {
+			want = []int64{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", path, got, want)
+		}
+	}
+}
+
+func TestSortChunksMergesInPasses(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	r := rand.New(rand.NewSource(1))
+	ids := make([]int64, 1000)
+	for i := range ids {
+		ids[i] = r.Int63n(400) - 200
+	}
+	next := func() (int64, error) {
+		if len(ids) == 0 {
+			return 0, io.EOF
+		}
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}
+	want := append([]int64(nil), ids...)
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+
+	// 1000 IDs in chunks of 7 take four passes of merging three chunks at once before the final merge
+	index, err := sortChunks(next, 7, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.f.Close()
+	if index.Len() != int64(len(want)) {
+		t.Fatalf("got %d IDs, want %d", index.Len(), len(want))
+	}
+	var got []int64
+	err = index.Scan(context.Background(), 0, index.Len(), func(id int64) {
+		got = append(got, id)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("index is not the sorted IDs")
+	}
+
+	// Every chunk is removed and the index is unlinked once created
+	left, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 0 {
+		t.Errorf("%d temporary files left behind", len(left))
+	}
+
+	for _, id := range []int64{-201, -200, 0, 57, 199, 200} {
+		pos, err := lowerBound(index, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := int64(sort.Search(len(want), func(i int) bool { return want[i] >= id })); pos != want {
+			t.Errorf("lowerBound(%d) = %d, want %d", id, pos, want)
+		}
+	}
+}
+
+func TestFileDataSourceHistogram(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids.txt")
+	err := os.WriteFile(path, []byte("-11\n-10\n-1\n0\n9\n10\n10\n35\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inMemory := range []bool{true, false} {
+		s, err := NewFileDataSource(path, FileFormat{Format: "text"}, inMemory)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.FetchHistogramRange(context.Background(), -10, 35, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := histogram.Histogram{
+			Bins:        histogram.Bins{{Key: -10, Count: 2}, {Key: 0, Count: 2}, {Key: 10, Count: 2}},
+			BinCapacity: 10,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("in memory %t: got %v, want %v", inMemory, got, want)
+		}
+
+		// The bins start at the lower bound of the range rather than on multiples of the interval
+		got, err = s.FetchHistogramRange(context.Background(), -11, 36, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = histogram.Histogram{
+			Bins:        histogram.Bins{{Key: -11, Count: 2}, {Key: -1, Count: 2}, {Key: 9, Count: 3}, {Key: 29, Count: 1}},
+			BinCapacity: 10,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("in memory %t: got %v, want %v", inMemory, got, want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/arturom/datadiff/histogram"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoCollection is the part of *mongo.Collection queried by MongoDataSource
+type mongoCollection interface {
+	Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error)
+	Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error)
+}
+
+// MongoDataSource uses a MongoDB collection to implement the datasource interface
+type MongoDataSource struct {
+	collection mongoCollection
+	field      string
+	filter     bson.D
+}
+
+// NewMongoDataSource creates a data source over the numeric IDs at a field, which may be _id.
+// The optional filter restricts the documents that are compared.
+func NewMongoDataSource(collection *mongo.Collection, field string, filter bson.D) *MongoDataSource {
+	return &MongoDataSource{
+		collection: collection,
+		field:      field,
+		filter:     filter,
+	}
+}
+
+func (s MongoDataSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	// The remainder takes the sign of the ID, so it is shifted to round negative IDs down
+	field := "$" + s.field
+	remainder := bson.D{{Key: "$mod", Value: bson.A{
+		bson.D{{Key: "$add", Value: bson.A{
+			bson.D{{Key: "$mod", Value: bson.A{field, interval}}},
+			interval,
+		}}},
+		interval,
+	}}}
+	return s.aggregateHistogram(ctx, s.filter, remainder, interval)
+}
+
+func (s MongoDataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	// Bins start at gte, and the offset of every ID in the range from gte is never negative
+	field := "$" + s.field
+	remainder := bson.D{{Key: "$mod", Value: bson.A{
+		bson.D{{Key: "$subtract", Value: bson.A{field, gte}}},
+		interval,
+	}}}
+	return s.aggregateHistogram(ctx, s.rangeFilter(gte, lt), remainder, interval)
+}
+
+func (s MongoDataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	cursor, err := s.collection.Find(ctx, s.rangeFilter(gte, lt), options.Find().
+		SetProjection(bson.D{{Key: s.field, Value: 1}}).
+		SetSort(bson.D{{Key: s.field, Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	path := strings.Split(s.field, ".")
+	ids := []int64{}
+	for cursor.Next(ctx) {
+		id, err := rawToID(cursor.Current.Lookup(path...))
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, cursor.Err()
+}
+
+func (s MongoDataSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error) {
+	projection := bson.D{{Key: s.field, Value: 1}}
+	for _, f := range fields {
+		projection = append(projection, bson.E{Key: f, Value: 1})
+	}
+	cursor, err := s.collection.Find(ctx, s.rangeFilter(gte, lt), options.Find().
+		SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	path := strings.Split(s.field, ".")
+	records := make(map[int64]Record)
+	for cursor.Next(ctx) {
+		id, err := rawToID(cursor.Current.Lookup(path...))
+		if err != nil {
+			return nil, err
+		}
+		r := make(Record, len(fields))
+		for _, f := range fields {
+			raw, err := cursor.Current.LookupErr(strings.Split(f, ".")...)
+			if err != nil {
+				continue
+			}
+			var v interface{}
+			err = raw.Unmarshal(&v)
+			if err != nil {
+				return nil, err
+			}
+			r[f] = v
+		}
+		records[id] = r
+	}
+	return records, cursor.Err()
+}
+
+// aggregateHistogram groups the matching documents by bin key, the ID less its remainder within its bin. The key is
+// computed with $mod on 64-bit integers rather than $divide, which would round large IDs through doubles.
+// Grouping may spill to disk, since a small interval over a large collection outgrows the memory limit of a stage.
+func (s MongoDataSource) aggregateHistogram(ctx context.Context, filter bson.D, remainder bson.D, interval int64) (histogram.Histogram, error) {
+	field := "$" + s.field
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: bson.D{{Key: "$subtract", Value: bson.A{field, remainder}}}},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+
+	cursor, err := s.collection.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+	defer cursor.Close(ctx)
+
+	bins := make(histogram.Bins, 0)
+	for cursor.Next(ctx) {
+		key, err := rawToID(cursor.Current.Lookup("_id"))
+		if err != nil {
+			return histogram.Histogram{}, err
+		}
+		count, err := rawToID(cursor.Current.Lookup("count"))
+		if err != nil {
+			return histogram.Histogram{}, err
+		}
+		bins = append(bins, histogram.Bin{
+			Key:   key,
+			Count: count,
+		})
+	}
+
+	return histogram.Histogram{
+		BinCapacity: interval,
+		Bins:        bins,
+	}, cursor.Err()
+}
+
+// rangeFilter combines the configured filter with the ID range
+func (s MongoDataSource) rangeFilter(gte, lt int64) bson.D {
+	r := bson.D{{Key: s.field, Value: bson.D{
+		{Key: "$gte", Value: gte},
+		{Key: "$lt", Value: lt},
+	}}}
+	if len(s.filter) == 0 {
+		return r
+	}
+	return bson.D{{Key: "$and", Value: bson.A{s.filter, r}}}
+}
+
+// rawToID converts a numeric BSON value to an exact integer, rejecting doubles with a fraction
+func rawToID(v bson.RawValue) (int64, error) {
+	switch v.Type {
+	case bsontype.Int32:
+		return int64(v.Int32()), nil
+	case bsontype.Int64:
+		return v.Int64(), nil
+	case bsontype.Double:
+		f := v.Double()
+		if f != math.Trunc(f) || math.Abs(f) > 1<<53 {
+			return 0, fmt.Errorf("ID %v cannot be represented exactly as an integer", f)
+		}
+		return int64(f), nil
+	}
+	return 0, fmt.Errorf("Expected a numeric ID but found BSON type %s", v.Type)
+}
+
+var _ DataSource = (*MongoDataSource)(nil)
+var _ RecordFetcher = (*MongoDataSource)(nil)
@@ -0,0 +1,287 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/arturom/datadiff/histogram"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeCollection evaluates the filters and pipelines built by MongoDataSource over documents held in memory.
+// Aggregation expressions are computed on 64-bit integers, with $mod taking the sign of the dividend like MongoDB.
+type fakeCollection struct {
+	docs      []bson.M
+	pipelines []mongo.Pipeline
+	aggregate []*options.AggregateOptions
+}
+
+func (c *fakeCollection) Find(ctx context.Context, filter interface{}, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	var found []bson.M
+	for _, d := range c.docs {
+		ok, err := matches(d, filter.(bson.D))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, d)
+		}
+	}
+	for _, o := range opts {
+		if o.Sort == nil {
+			continue
+		}
+		field := o.Sort.(bson.D)[0].Key
+		sort.SliceStable(found, func(i, j int) bool {
+			return toInt64(lookup(found[i], field)) < toInt64(lookup(found[j], field))
+		})
+	}
+	docs := make([]interface{}, len(found))
+	for i, d := range found {
+		docs[i] = d
+	}
+	return mongo.NewCursorFromDocuments(docs, nil, nil)
+}
+
+func (c *fakeCollection) Aggregate(ctx context.Context, pipeline interface{}, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+	p := pipeline.(mongo.Pipeline)
+	c.pipelines = append(c.pipelines, p)
+	c.aggregate = append(c.aggregate, opts...)
+
+	docs := c.docs
+	for _, stage := range p {
+		switch stage[0].Key {
+		case "$match":
+			var matched []bson.M
+			for _, d := range docs {
+				ok, err := matches(d, stage[0].Value.(bson.D))
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					matched = append(matched, d)
+				}
+			}
+			docs = matched
+		case "$group":
+			group := stage[0].Value.(bson.D)
+			counts := make(map[int64]int64)
+			for _, d := range docs {
+				key, err := evaluate(d, group[0].Value)
+				if err != nil {
+					return nil, err
+				}
+				counts[key]++
+			}
+			docs = nil
+			for key, count := range counts {
+				docs = append(docs, bson.M{"_id": key, "count": int32(count)})
+			}
+		case "$sort":
+			sort.Slice(docs, func(i, j int) bool {
+				return docs[i]["_id"].(int64) < docs[j]["_id"].(int64)
+			})
+		default:
+			return nil, fmt.Errorf("unexpected stage %s", stage[0].Key)
+		}
+	}
+	out := make([]interface{}, len(docs))
+	for i, d := range docs {
+		out[i] = d
+	}
+	return mongo.NewCursorFromDocuments(out, nil, nil)
+}
+
+// matches evaluates the equality, $gte, $lt and $and operators of a filter
+func matches(doc bson.M, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		if e.Key == "$and" {
+			for _, f := range e.Value.(bson.A) {
+				ok, err := matches(doc, f.(bson.D))
+				if !ok || err != nil {
+					return false, err
+				}
+			}
+			continue
+		}
+		cond, ok := e.Value.(bson.D)
+		if !ok {
+			if lookup(doc, e.Key) != e.Value {
+				return false, nil
+			}
+			continue
+		}
+		v := toInt64(lookup(doc, e.Key))
+		for _, c := range cond {
+			bound := c.Value.(int64)
+			switch c.Key {
+			case "$gte":
+				if v < bound {
+					return false, nil
+				}
+			case "$lt":
+				if v >= bound {
+					return false, nil
+				}
+			default:
+				return false, fmt.Errorf("unexpected operator %s", c.Key)
+			}
+		}
+	}
+	return true, nil
+}
+
+// evaluate computes an aggregation expression of field paths, integers, $mod, $add and $subtract
+func evaluate(doc bson.M, expr interface{}) (int64, error) {
+	switch e := expr.(type) {
+	case string:
+		return toInt64(lookup(doc, strings.TrimPrefix(e, "$"))), nil
+	case int64:
+		return e, nil
+	case bson.D:
+		args := e[0].Value.(bson.A)
+		a, err := evaluate(doc, args[0])
+		if err != nil {
+			return 0, err
+		}
+		b, err := evaluate(doc, args[1])
+		if err != nil {
+			return 0, err
+		}
+		switch e[0].Key {
+		case "$mod":
+			return a % b, nil
+		case "$add":
+			return a + b, nil
+		case "$subtract":
+			return a - b, nil
+		}
+		return 0, fmt.Errorf("unexpected operator %s", e[0].Key)
+	}
+	return 0, fmt.Errorf("unexpected expression %v", expr)
+}
+
+func lookup(doc bson.M, path string) interface{} {
+	var v interface{} = doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(bson.M)
+		if !ok {
+			return nil
+		}
+		v = m[key]
+	}
+	return v
+}
+
+func toInt64(v interface{}) int64 {
+	switch n := v.(type) {
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	case float64:
+		return int64(n)
+	}
+	return math.MinInt64
+}
+
+func TestMongoFetchHistogramRange(t *testing.T) {
+	c := &fakeCollection{}
+	for _, id := range []int64{-7, -5, -1, 0, 3, 9, 10, math.MaxInt64} {
+		c.docs = append(c.docs, bson.M{"order": bson.M{"id": id}})
+	}
+	// 32-bit and integral double IDs are read exactly
+	c.docs = append(c.docs, bson.M{"order": bson.M{"id": int32(4)}}, bson.M{"order": bson.M{"id": float64(-6)}})
+	s := MongoDataSource{collection: c, field: "order.id"}
+
+	got, err := s.FetchHistogramRange(context.Background(), -10, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := histogram.Histogram{
+		Bins:        histogram.Bins{{Key: -10, Count: 2}, {Key: -5, Count: 2}, {Key: 0, Count: 3}, {Key: 5, Count: 1}},
+		BinCapacity: 5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if len(c.aggregate) != 1 || c.aggregate[0].AllowDiskUse == nil || !*c.aggregate[0].AllowDiskUse {
+		t.Errorf("histogram aggregation does not allow disk use")
+	}
+
+	// The bins start at the lower bound of the range rather than on multiples of the interval
+	got, err = s.FetchHistogramRange(context.Background(), -7, 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = histogram.Histogram{
+		Bins:        histogram.Bins{{Key: -7, Count: 3}, {Key: -2, Count: 2}, {Key: 3, Count: 2}, {Key: 8, Count: 1}},
+		BinCapacity: 5,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	got, err = s.FetchHistogramAll(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := got.Bins[len(got.Bins)-1]; last != (histogram.Bin{Key: math.MaxInt64 - 7, Count: 1}) {
+		t.Errorf("got last bin %v, want %d", last, int64(math.MaxInt64-7))
+	}
+}
+
+func TestMongoFetchIDRangeWithFilter(t *testing.T) {
+	c := &fakeCollection{docs: []bson.M{
+		{"_id": int64(9), "status": "active"},
+		{"_id": int64(2), "status": "active"},
+		{"_id": int64(5), "status": "deleted"},
+		{"_id": int64(4), "status": "active"},
+		{"_id": int64(12), "status": "active"},
+	}}
+	s := NewMongoDataSource(nil, "_id", bson.D{{Key: "status", Value: "active"}})
+	s.collection = c
+
+	got, err := s.FetchIDRange(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{2, 4, 9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMongoFetchIDRangeRejectsFractions(t *testing.T) {
+	c := &fakeCollection{docs: []bson.M{{"_id": 1.5}}}
+	s := MongoDataSource{collection: c, field: "_id"}
+	_, err := s.FetchIDRange(context.Background(), 0, 10)
+	if err == nil || !strings.Contains(err.Error(), "cannot be represented exactly") {
+		t.Errorf("got error %v, want an inexact ID error", err)
+	}
+}
+
+func TestMongoFetchRecordRange(t *testing.T) {
+	c := &fakeCollection{docs: []bson.M{
+		{"_id": int64(1), "name": "a", "price": bson.M{"amount": 2.5}},
+		{"_id": int64(2), "name": "b"},
+	}}
+	s := MongoDataSource{collection: c, field: "_id"}
+	got, err := s.FetchRecordRange(context.Background(), 0, 10, []string{"name", "price.amount"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]Record{
+		1: {"name": "a", "price.amount": 2.5},
+		2: {"name": "b"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
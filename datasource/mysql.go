@@ -1,9 +1,14 @@
 package datasource
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/arturom/datadiff/histogram"
 	// Import the sql driver but use the sql interfaces
@@ -15,102 +20,381 @@ type MysqlDataSource struct {
 	Tablename  string
 	FieldName  string
 	Conditions []string
+	// ChecksumFields are the columns compared when checking records for modifications
+	ChecksumFields []string
+	// Unsigned reads a BIGINT UNSIGNED ID column, compared through the keys of its IDs
+	Unsigned bool
 }
 
-func (s MysqlDataSource) FetchHistogramAll(interval int) (histogram.Histogram, error) {
-	q := query{}
-	q.selectField(fmt.Sprintf("FLOOR(%[1]s / %[2]d) * %[2]d AS `BinKey`", s.FieldName, interval)).
+func (s MysqlDataSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	q := s.newQuery(ctx)
+	q.selectField(fmt.Sprintf("FLOOR(%[1]s / %[2]d) * %[2]d AS `BinKey`", s.idColumn(), interval)).
 		selectField("COUNT(*) AS `Count`").
 		from(s.Tablename).
 		where(s.Conditions...).
 		group("`BinKey`")
+	s.selectChecksum(q)
 
-	rows, err := s.DB.Query(q.string())
+	return queryHistogram(ctx, s.DB, q, interval, s.ChecksumsEnabled())
+}
+
+func (s MysqlDataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	q := s.newQuery(ctx)
+	q.selectField(sqlBinKey(s.idColumn(), gte, interval) + " AS `BinKey`").
+		selectField("COUNT(*) AS `Count`").
+		from(s.Tablename).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...).
+		group("`BinKey`")
+	s.selectChecksum(q)
+
+	return queryHistogram(ctx, s.DB, q, interval, s.ChecksumsEnabled())
+}
+
+// newQuery starts a query that MySQL stops by itself at the deadline of the context. Cancelling a query only
+// closes its connection on the client side, which leaves the server running it until it completes.
+func (s MysqlDataSource) newQuery(ctx context.Context) *query {
+	q := &query{}
+	if d, ok := ctx.Deadline(); ok {
+		q.hint(fmt.Sprintf("MAX_EXECUTION_TIME(%d)", max(time.Until(d).Milliseconds(), 1)))
+	}
+	return q
+}
+
+func (s MysqlDataSource) ChecksumsEnabled() bool {
+	return len(s.ChecksumFields) != 0
+}
+
+func (s MysqlDataSource) ChecksumEngine() string {
+	return "mysql"
+}
+
+func (s MysqlDataSource) FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error) {
+	if !s.ChecksumsEnabled() {
+		return nil, fmt.Errorf("No checksum fields configured for table %s", s.Tablename)
+	}
+	q := s.newQuery(ctx)
+	q.selectField(s.idColumn()).
+		selectField(s.recordChecksum()).
+		from(s.Tablename).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryChecksums(ctx, s.DB, *q)
+}
+
+func (s MysqlDataSource) recordChecksum() string {
+	fields := make([]string, len(s.ChecksumFields))
+	for i, f := range s.ChecksumFields {
+		fields[i] = fmt.Sprintf("`%s`", f)
+	}
+	return fmt.Sprintf("CRC32(CONCAT_WS('|', %s))", strings.Join(fields, ", "))
+}
+
+func (s MysqlDataSource) selectChecksum(q *query) {
+	if s.ChecksumsEnabled() {
+		q.selectField(fmt.Sprintf("BIT_XOR(%s) AS `Checksum`", s.recordChecksum()))
+	}
+}
+
+func (s MysqlDataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	q := s.newQuery(ctx)
+	q.selectField(s.idColumn()).
+		from(s.Tablename).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryIDs(ctx, s.DB, *q)
+}
+
+func (s MysqlDataSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error) {
+	q := s.newQuery(ctx)
+	q.selectField(s.idColumn())
+	for _, f := range fields {
+		q.selectField(fmt.Sprintf("`%s`", f))
+	}
+	q.from(s.Tablename).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryRecords(ctx, s.DB, *q, fields)
+}
+
+func (s MysqlDataSource) ReadRecords(ctx context.Context, ids []int64) (map[int64]Record, error) {
+	q := s.newQuery(ctx)
+	q.selectField("*").
+		from(s.Tablename).
+		where(fmt.Sprintf("`%s` IN (%s)", s.FieldName, joinIDs(ids, s.Unsigned))).
+		where(s.Conditions...)
+
+	return queryRows(ctx, s.DB, *q, s.FieldName, s.Unsigned)
+}
+
+// idColumn renders the key of the ID column. Flipping the top bit of an unsigned ID and casting it maps
+// the ID onto its key, like UnsignedKey.
+func (s MysqlDataSource) idColumn() string {
+	if s.Unsigned {
+		return fmt.Sprintf("CAST(`%s` ^ 9223372036854775808 AS SIGNED)", s.FieldName)
+	}
+	return fmt.Sprintf("`%s`", s.FieldName)
+}
+
+// rangeConditions compare the ID column itself to the IDs of the keys, so that its index is used
+func (s MysqlDataSource) rangeConditions(gte, lt int64) []string {
+	return []string{
+		fmt.Sprintf("`%s` >= %s", s.FieldName, FormatID(gte, s.Unsigned)),
+		fmt.Sprintf("`%s` < %s", s.FieldName, FormatID(lt, s.Unsigned)),
+	}
+}
+
+// queryIDs runs a query selecting a single ID column
+func queryIDs(ctx context.Context, db *sql.DB, q query) ([]int64, error) {
+	rows, err := db.QueryContext(ctx, q.string())
 
 	if err != nil {
-		return histogram.Histogram{}, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	bins := make(histogram.Bins, 0)
+	ids := []int64{}
 
 	for rows.Next() {
-		var key, count int
-		rows.Scan(&key, &count)
-		bins = append(bins, histogram.Bin{
-			Key:   key,
-			Count: count,
-		})
+		// Scanning into int64 fails loudly rather than wrapping if an unsigned ID exceeds the signed range
+		var id int64
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
 	}
 
-	return histogram.Histogram{
-		BinCapacity: interval,
-		Bins:        bins,
-	}, nil
+	return ids, rows.Err()
 }
 
-func (s MysqlDataSource) FetchHistogramRange(gte, lt, interval int) (histogram.Histogram, error) {
-	q := query{}
-	q.selectField(fmt.Sprintf("FLOOR(%[1]s / %[2]d) * %[2]d AS `BinKey`", s.FieldName, interval)).
-		selectField("COUNT(*) AS `Count`").
-		from(s.Tablename).
-		where(fmt.Sprintf("`%s` >= %d", s.FieldName, gte), fmt.Sprintf("`%s` < %d", s.FieldName, lt)).
-		where(s.Conditions...).
-		group("`BinKey`")
+// queryChecksums runs a query selecting IDs and their record checksums
+func queryChecksums(ctx context.Context, db *sql.DB, q query) (map[int64]uint32, error) {
+	rows, err := db.QueryContext(ctx, q.string())
+
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	rows, err := s.DB.Query(q.string())
+	checksums := make(map[int64]uint32)
+
+	for rows.Next() {
+		var id int64
+		var checksum uint32
+		err = rows.Scan(&id, &checksum)
+		if err != nil {
+			return nil, err
+		}
+		checksums[id] = checksum
+	}
+
+	return checksums, rows.Err()
+}
+
+// queryRecords runs a query selecting an ID column followed by the given fields
+func queryRecords(ctx context.Context, db *sql.DB, q query, fields []string) (map[int64]Record, error) {
+	rows, err := db.QueryContext(ctx, q.string())
 
 	if err != nil {
-		return histogram.Histogram{}, err
+		return nil, err
 	}
+	defer rows.Close()
 
-	bins := make(histogram.Bins, 0)
+	records := make(map[int64]Record)
 
 	for rows.Next() {
-		var key, count int
-		rows.Scan(&key, &count)
-		bins = append(bins, histogram.Bin{
-			Key:   key,
-			Count: count,
-		})
+		var id int64
+		values := make([]interface{}, len(fields))
+		dest := make([]interface{}, len(fields)+1)
+		dest[0] = &id
+		for i := range values {
+			dest[i+1] = &values[i]
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+		r := make(Record, len(fields))
+		for i, f := range fields {
+			// Drivers may reuse the scanned bytes on the next row
+			if b, ok := values[i].([]byte); ok {
+				values[i] = string(b)
+			}
+			r[f] = values[i]
+		}
+		records[id] = r
 	}
 
-	return histogram.Histogram{
-		BinCapacity: interval,
-		Bins:        bins,
-	}, nil
+	return records, rows.Err()
 }
 
-func (s MysqlDataSource) FetchIDRange(gte, lt int) ([]int, error) {
-	q := query{}
-	q.selectField(fmt.Sprintf("`%s`", s.FieldName)).
-		from(s.Tablename).
-		where(fmt.Sprintf("`%s` >= %d", s.FieldName, gte), fmt.Sprintf("`%s` < %d", s.FieldName, lt)).
-		where(s.Conditions...)
+// queryRows runs a query selecting whole rows, keyed by the value of the ID column, or by its key when unsigned.
+// Values are converted to the types of their columns, since some drivers return numbers as text.
+func queryRows(ctx context.Context, db *sql.DB, q query, idColumn string, unsigned bool) (map[int64]Record, error) {
+	rows, err := db.QueryContext(ctx, q.string())
 
-	rows, err := s.DB.Query(q.string())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
+	columns, err := rows.ColumnTypes()
 	if err != nil {
 		return nil, err
 	}
 
-	ids := []int{}
+	records := make(map[int64]Record)
 
 	for rows.Next() {
-		var id int
-		rows.Scan(&id)
-		ids = append(ids, id)
+		values := make([]interface{}, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return nil, err
+		}
+
+		r := make(Record, len(columns))
+		for i, c := range columns {
+			r[c.Name()], err = columnValue(values[i], c)
+			if err != nil {
+				return nil, err
+			}
+		}
+		id, err := rowID(r[idColumn], unsigned)
+		if err != nil {
+			return nil, fmt.Errorf("Column %s: %w", idColumn, err)
+		}
+		records[id] = r
 	}
 
-	return ids, nil
+	return records, rows.Err()
 }
 
+// rowID returns the key of an ID read from a row. Unsigned IDs may be read as int64 when small enough,
+// or as uint64 or decimal text when not.
+func rowID(v interface{}, unsigned bool) (int64, error) {
+	switch v := v.(type) {
+	case int64:
+		if !unsigned {
+			return v, nil
+		}
+		if v >= 0 {
+			return UnsignedKey(uint64(v)), nil
+		}
+	case uint64:
+		if unsigned {
+			return UnsignedKey(v), nil
+		}
+		if v <= math.MaxInt64 {
+			return int64(v), nil
+		}
+	case json.Number:
+		return ParseID(v.String(), unsigned)
+	default:
+		return 0, fmt.Errorf("Expected a numeric ID but found %v", v)
+	}
+	if unsigned {
+		return 0, fmt.Errorf("ID %v is out of the unsigned 64-bit range", v)
+	}
+	return 0, fmt.Errorf("ID %v exceeds the signed 64-bit range, use -unsigned to compare unsigned IDs", v)
+}
+
+// columnValue converts a value scanned as text to the type of its column
+func columnValue(v interface{}, c *sql.ColumnType) (interface{}, error) {
+	b, ok := v.([]byte)
+	if !ok {
+		return v, nil
+	}
+	t := strings.ToUpper(c.DatabaseTypeName())
+	switch {
+	case strings.HasSuffix(t, "INT") || t == "INTEGER" || t == "INT2" || t == "INT4" || t == "INT8":
+		if strings.HasPrefix(t, "UNSIGNED") {
+			return strconv.ParseUint(string(b), 10, 64)
+		}
+		return strconv.ParseInt(string(b), 10, 64)
+	case t == "DECIMAL" || t == "NUMERIC" || t == "FLOAT" || t == "DOUBLE" || t == "REAL" ||
+		t == "FLOAT4" || t == "FLOAT8":
+		// Kept as text so that decimals are written without rounding
+		return json.Number(b), nil
+	}
+	return string(b), nil
+}
+
+// joinIDs lists the IDs of the given keys
+func joinIDs(ids []int64, unsigned bool) string {
+	s := make([]string, len(ids))
+	for i, id := range ids {
+		s[i] = FormatID(id, unsigned)
+	}
+	return strings.Join(s, ", ")
+}
+
+// sqlBinKey renders the key of the bin holding an ID column for the bins of FetchHistogramRange, which start at gte.
+// The offset from gte is never negative within the range, so the remainder rounds down in every SQL engine.
+func sqlBinKey(column string, gte, interval int64) string {
+	offset := fmt.Sprintf("%s - %d", column, gte)
+	if gte < 0 {
+		offset = fmt.Sprintf("%s - (%d)", column, gte)
+	}
+	return fmt.Sprintf("%s - (%s) %% %d", column, offset, interval)
+}
+
+// queryHistogram runs a query selecting bin keys and counts, followed by checksums when requested
+func queryHistogram(ctx context.Context, db *sql.DB, q *query, interval int64, checksum bool) (histogram.Histogram, error) {
+	rows, err := db.QueryContext(ctx, q.string())
+
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+	defer rows.Close()
+
+	bins := make(histogram.Bins, 0)
+
+	for rows.Next() {
+		var bin histogram.Bin
+		dest := []any{&bin.Key, &bin.Count}
+		if checksum {
+			dest = append(dest, &bin.Checksum)
+		}
+		err = rows.Scan(dest...)
+		if err != nil {
+			return histogram.Histogram{}, err
+		}
+		bins = append(bins, bin)
+	}
+
+	return histogram.Histogram{
+		BinCapacity: interval,
+		Bins:        bins,
+	}, rows.Err()
+}
+
+var _ DataSource = MysqlDataSource{}
+var _ Checksummer = MysqlDataSource{}
+var _ RecordFetcher = MysqlDataSource{}
+var _ RecordReader = MysqlDataSource{}
+
 type query struct {
+	// Hint is an optimizer hint placed after SELECT
+	Hint        string
 	Fields      []string
 	Table       string
 	Conditions  []string
 	GroupClause string
 }
 
+func (q *query) hint(h string) *query {
+	q.Hint = h
+	return q
+}
+
 func (q *query) selectField(f string) *query {
 	q.Fields = append(q.Fields, f)
 	return q
@@ -134,10 +418,11 @@ func (q *query) group(g string) *query {
 }
 
 func (q query) string() string {
-	ret := fmt.Sprintf(
-		"SELECT %s FROM %s",
-		strings.Join(q.Fields, ", "),
-		q.Table)
+	ret := "SELECT "
+	if q.Hint != "" {
+		ret += fmt.Sprintf("/*+ %s */ ", q.Hint)
+	}
+	ret += fmt.Sprintf("%s FROM %s", strings.Join(q.Fields, ", "), q.Table)
 	if len(q.Conditions) != 0 {
 		ret += fmt.Sprintf(" WHERE %s", strings.Join(q.Conditions, " AND "))
 	}
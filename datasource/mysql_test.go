@@ -0,0 +1,76 @@
+package datasource
+
+import (
+	"context"
+	"database/sql/driver"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/arturom/datadiff/histogram"
+)
+
+func TestMysqlQueryHintsDeadline(t *testing.T) {
+	s := MysqlDataSource{Tablename: "`orders`", FieldName: "id"}
+
+	q := s.newQuery(context.Background())
+	q.selectField("`id`").from(s.Tablename)
+	if got, want := q.string(), "SELECT `id` FROM `orders`"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	q = s.newQuery(ctx)
+	q.selectField("`id`").from(s.Tablename)
+	re := regexp.MustCompile("^SELECT /\\*\\+ MAX_EXECUTION_TIME\\((\\d+)\\) \\*/ `id` FROM `orders`$")
+	m := re.FindStringSubmatch(q.string())
+	if m == nil {
+		t.Fatalf("got %q, want a MAX_EXECUTION_TIME hint", q.string())
+	}
+	if ms, _ := strconv.Atoi(m[1]); ms <= 29000 || ms > 30000 {
+		t.Errorf("got MAX_EXECUTION_TIME(%d), want about 30000", ms)
+	}
+}
+
+func TestMysqlUnsignedIDs(t *testing.T) {
+	stub, db := newSQLStub(t)
+	s := MysqlDataSource{DB: db, Tablename: "`orders`", FieldName: "id", Unsigned: true}
+
+	// Bins are computed on the keys, while the range is compared to the IDs so that the index of the column is used
+	stub.answer(
+		"SELECT CAST(`id` ^ 9223372036854775808 AS SIGNED) - (CAST(`id` ^ 9223372036854775808 AS SIGNED) - 0) % 10 AS `BinKey`, COUNT(*) AS `Count` "+
+			"FROM `orders` WHERE `id` >= 9223372036854775808 AND `id` < 9223372036854775828 GROUP BY `BinKey`",
+		[]string{"BinKey", "Count"},
+		[]driver.Value{int64(10), int64(3)},
+	)
+	got, err := s.FetchHistogramRange(context.Background(), 0, 20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (histogram.Bins{{Key: 10, Count: 3}}); !reflect.DeepEqual(got.Bins, want) {
+		t.Errorf("got %v, want %v", got.Bins, want)
+	}
+
+	// Whole rows hold the IDs themselves, which are keyed like the histograms
+	stub.answer(
+		"SELECT * FROM `orders` WHERE `id` IN (9223372036854775818, 18446744073709551615)",
+		[]string{"id", "name"},
+		[]driver.Value{uint64(1<<63 + 10), "a"},
+		[]driver.Value{uint64(math.MaxUint64), "b"},
+	)
+	rows, err := s.ReadRecords(context.Background(), []int64{10, math.MaxInt64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]Record{
+		10:            {"id": uint64(1<<63 + 10), "name": "a"},
+		math.MaxInt64: {"id": uint64(math.MaxUint64), "name": "b"},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("got %v, want %v", rows, want)
+	}
+}
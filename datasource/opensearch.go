@@ -0,0 +1,137 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	h "github.com/arturom/datadiff/histogram"
+	"github.com/elastic/go-elasticsearch/v8/typedapi/core/search"
+	"github.com/opensearch-project/opensearch-go/v2"
+)
+
+// OpenSearchDataSource uses an OpenSearch cluster to implement the datasource interface.
+// OpenSearch accepts the same histogram and range queries as Elasticsearch 7.
+type OpenSearchDataSource struct {
+	client *opensearch.Client
+	index  string
+	field  idField
+	// checksumFields are the fields compared when checking records for modifications
+	checksumFields []string
+}
+
+func NewOpenSearchDataSource(client *opensearch.Client, index, field string) *OpenSearchDataSource {
+	return &OpenSearchDataSource{
+		client: client,
+		index:  index,
+		field:  idField{name: field},
+	}
+}
+
+func (es OpenSearchDataSource) FetchHistogramAll(ctx context.Context, interval int64) (h.Histogram, error) {
+	return es.histogram(ctx, math.MinInt64, math.MaxInt64, 0, interval)
+}
+
+func (es OpenSearchDataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (h.Histogram, error) {
+	return es.histogram(ctx, gte, lt, gte, interval)
+}
+
+// histogram bins the IDs of a range in bins laid out from origin
+func (es OpenSearchDataSource) histogram(ctx context.Context, gte, lt, origin, interval int64) (h.Histogram, error) {
+	bin := func(ctx context.Context, gte, lt int64) (h.Histogram, error) {
+		return fetchBinPages(ctx, es, es.field, gte, lt, origin, interval, es.checksumFields)
+	}
+	// Histograms aggregate the IDs rather than their keys, so unsigned IDs are all binned with the script
+	if es.field.unsigned {
+		return exactHistogramRange(ctx, gte, lt, origin, interval, es.fetchDocs, bin, bin)
+	}
+	return exactHistogramRange(ctx, gte, lt, origin, interval, es.fetchDocs, func(ctx context.Context, gte, lt int64) (h.Histogram, error) {
+		req := createHistogramRequest(es.field.name, origin, interval)
+		req.Query = createRangeQuery(es.field, gte, lt)
+		if es.ChecksumsEnabled() {
+			addChecksumAggregation(req, es.checksumFields)
+		}
+		res, err := es.search(ctx, req)
+		if err != nil {
+			return h.Histogram{}, err
+		}
+		return extractHistogramFromResponse(res, origin, interval)
+	}, bin)
+}
+
+func (es OpenSearchDataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	return fetchIDPages(ctx, es, es.field, gte, lt)
+}
+
+func (es OpenSearchDataSource) ChecksumsEnabled() bool {
+	return len(es.checksumFields) != 0
+}
+
+// ChecksumEngine returns elasticsearch, as Elasticsearch and OpenSearch render fields with the same script
+func (es OpenSearchDataSource) ChecksumEngine() string {
+	return "elasticsearch"
+}
+
+func (es OpenSearchDataSource) FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error) {
+	if !es.ChecksumsEnabled() {
+		return nil, fmt.Errorf("No checksum fields configured for index %s", es.index)
+	}
+	return fetchChecksumPages(ctx, es, es.field, gte, lt, es.checksumFields)
+}
+
+// fetchDocs fetches the IDs of a range along with the checksums of their records when enabled
+func (es OpenSearchDataSource) fetchDocs(ctx context.Context, gte, lt int64) ([]int64, []uint32, error) {
+	return fetchDocPages(ctx, es, es.field, gte, lt, es.checksumFields)
+}
+
+func (es OpenSearchDataSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error) {
+	return fetchRecordPages(ctx, es, es.field, gte, lt, fields)
+}
+
+func (es OpenSearchDataSource) search(ctx context.Context, req *search.Request) (*searchResponse, error) {
+	buf, err := marshallRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	res, err := es.client.Search(
+		es.client.Search.WithContext(ctx),
+		es.client.Search.WithIndex(es.index),
+		es.client.Search.WithBody(buf),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return readBody(res.Body)
+}
+
+// openPointInTime returns no point in time, so that pages are sorted on _id instead of _shard_doc,
+// which OpenSearch does not support
+func (es OpenSearchDataSource) openPointInTime(ctx context.Context) (string, error) {
+	return "", nil
+}
+
+func (es OpenSearchDataSource) closePointInTime(ctx context.Context, id string) error {
+	return nil
+}
+
+// validateField checks that the ID field is mapped as a numeric type in the index
+func (es OpenSearchDataSource) validateField() error {
+	res, err := es.client.Indices.GetFieldMapping(
+		[]string{es.field.name},
+		es.client.Indices.GetFieldMapping.WithContext(context.Background()),
+		es.client.Indices.GetFieldMapping.WithIndex(es.index),
+	)
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		res.Body.Close()
+		return fmt.Errorf("Failed to fetch mapping of field %s: %s", es.field.name, res.Status())
+	}
+	return checkFieldMapping(res.Body, es.field)
+}
+
+var _ DataSource = (*OpenSearchDataSource)(nil)
+var _ RecordFetcher = (*OpenSearchDataSource)(nil)
+var _ Checksummer = (*OpenSearchDataSource)(nil)
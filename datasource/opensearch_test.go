@@ -0,0 +1,132 @@
+package datasource
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	h "github.com/arturom/datadiff/histogram"
+	"github.com/opensearch-project/opensearch-go/v2"
+)
+
+func newTestOpenSearch(t *testing.T, ids ...int64) (*fakeES, *OpenSearchDataSource) {
+	f, srv := newFakeES(t, "orders", "id", ids...)
+	client, err := opensearch.NewClient(opensearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, NewOpenSearchDataSource(client, "orders", "id")
+}
+
+func TestOpenSearchFetchHistogramRange(t *testing.T) {
+	_, s := newTestOpenSearch(t, -3, 1, 2, 15, 1005, 2000)
+	got, err := s.FetchHistogramRange(context.Background(), -10, 2000, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := h.Histogram{
+		Bins:        h.Bins{{Key: -10, Count: 1}, {Key: 0, Count: 2}, {Key: 10, Count: 1}, {Key: 1000, Count: 1}},
+		BinCapacity: 10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestOpenSearchFetchHistogramAllBeyondExactDoubles(t *testing.T) {
+	_, s := newTestOpenSearch(t, 7, maxExactID+1, maxExactID+3)
+	got, err := s.FetchHistogramAll(context.Background(), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := h.Histogram{
+		Bins:        h.Bins{{Key: 6, Count: 1}, {Key: maxExactID, Count: 1}, {Key: maxExactID + 2, Count: 1}},
+		BinCapacity: 2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestOpenSearchFetchIDRange(t *testing.T) {
+	var ids []int64
+	for i := int64(0); i < 2*idPageSize+10; i++ {
+		ids = append(ids, 2*idPageSize+9-i)
+	}
+	f, s := newTestOpenSearch(t, ids...)
+	got, err := s.FetchIDRange(context.Background(), 5, 2*idPageSize+5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2*idPageSize {
+		t.Fatalf("got %d IDs, want %d", len(got), 2*idPageSize)
+	}
+	for i, id := range got {
+		if id != int64(5+i) {
+			t.Fatalf("ID %d = %d, want %d", i, id, 5+i)
+		}
+	}
+	// The first page is read again along with the others, sorted on _id to tell documents sharing an ID apart
+	if n := len(f.searched()); n != 4 {
+		t.Errorf("got %d requests, want a first page followed by 3 pages", n)
+	}
+	if sort := f.searched()[1]["sort"]; !reflect.DeepEqual(sort, []interface{}{"id", "_id"}) {
+		t.Errorf("sort = %v, want [id _id]", sort)
+	}
+}
+
+func TestOpenSearchFetchRecordRange(t *testing.T) {
+	f, s := newTestOpenSearch(t)
+	f.add(
+		map[string]interface{}{"id": int64(1), "name": "a", "price": map[string]interface{}{"amount": 2.5}},
+		map[string]interface{}{"id": int64(2), "name": "b"},
+		map[string]interface{}{"id": int64(3), "name": "c"},
+	)
+	got, err := s.FetchRecordRange(context.Background(), 1, 3, []string{"name", "price.amount"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1]["name"] != "a" || got[2]["name"] != "b" {
+		t.Errorf("got %v, want records 1 and 2", got)
+	}
+	if _, ok := got[2]["price.amount"]; ok {
+		t.Errorf("got a price for record 2, which has none")
+	}
+	if got[1]["price.amount"] == nil {
+		t.Errorf("got no price for record 1")
+	}
+}
+
+func TestOpenSearchValidateField(t *testing.T) {
+	f, s := newTestOpenSearch(t)
+	err := s.validateField()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mapAs("keyword")
+	err = s.validateField()
+	if err == nil || !strings.Contains(err.Error(), "non-numeric type: keyword") {
+		t.Errorf("got error %v, want a non-numeric type error", err)
+	}
+
+	f.mapAs("")
+	err = s.validateField()
+	if err == nil || !strings.Contains(err.Error(), "Field id is not mapped in index orders") {
+		t.Errorf("got error %v, want an unmapped field error", err)
+	}
+}
+
+func TestOpenSearchSearchFailure(t *testing.T) {
+	_, srv := newFakeES(t, "orders", "id")
+	client, err := opensearch.NewClient(opensearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewOpenSearchDataSource(client, "missing", "id")
+	_, err = s.FetchIDRange(context.Background(), 0, 10)
+	if err == nil || !strings.Contains(err.Error(), "Search failed") {
+		t.Errorf("got error %v, want a failed search", err)
+	}
+}
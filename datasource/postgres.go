@@ -0,0 +1,159 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/arturom/datadiff/histogram"
+	// Registers the postgres sql driver and provides identifier quoting
+	"github.com/lib/pq"
+)
+
+// PostgresDataSource uses a PostgreSQL table to implement the datasource interface.
+// The table name may be schema-qualified, as in "schema.table".
+type PostgresDataSource struct {
+	DB         *sql.DB
+	Tablename  string
+	FieldName  string
+	Conditions []string
+	// ChecksumFields are the columns compared when checking records for modifications.
+	// Checksums use the crc32 function of PostgreSQL 18.
+	ChecksumFields []string
+	// Unsigned reads a NUMERIC ID column holding unsigned 64-bit IDs, compared through the keys of its IDs
+	Unsigned bool
+}
+
+func (s PostgresDataSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	q := &query{}
+	q.selectField(s.binKey(interval)).
+		selectField(`COUNT(*) AS "count"`).
+		from(s.table()).
+		where(s.Conditions...).
+		group(`"bin_key"`)
+	s.selectChecksum(q)
+
+	return queryHistogram(ctx, s.DB, q, interval, s.ChecksumsEnabled())
+}
+
+func (s PostgresDataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	q := &query{}
+	q.selectField(sqlBinKey(s.idColumn(), gte, interval) + ` AS "bin_key"`).
+		selectField(`COUNT(*) AS "count"`).
+		from(s.table()).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...).
+		group(`"bin_key"`)
+	s.selectChecksum(q)
+
+	return queryHistogram(ctx, s.DB, q, interval, s.ChecksumsEnabled())
+}
+
+func (s PostgresDataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	q := query{}
+	q.selectField(s.idColumn()).
+		from(s.table()).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryIDs(ctx, s.DB, q)
+}
+
+func (s PostgresDataSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error) {
+	q := query{}
+	q.selectField(s.idColumn())
+	for _, f := range fields {
+		q.selectField(pq.QuoteIdentifier(f))
+	}
+	q.from(s.table()).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryRecords(ctx, s.DB, q, fields)
+}
+
+func (s PostgresDataSource) ReadRecords(ctx context.Context, ids []int64) (map[int64]Record, error) {
+	q := query{}
+	q.selectField("*").
+		from(s.table()).
+		where(fmt.Sprintf("%s IN (%s)", pq.QuoteIdentifier(s.FieldName), joinIDs(ids, s.Unsigned))).
+		where(s.Conditions...)
+
+	return queryRows(ctx, s.DB, q, s.FieldName, s.Unsigned)
+}
+
+func (s PostgresDataSource) ChecksumsEnabled() bool {
+	return len(s.ChecksumFields) != 0
+}
+
+func (s PostgresDataSource) ChecksumEngine() string {
+	return "postgres"
+}
+
+func (s PostgresDataSource) FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error) {
+	if !s.ChecksumsEnabled() {
+		return nil, fmt.Errorf("No checksum fields configured for table %s", s.Tablename)
+	}
+	q := query{}
+	q.selectField(s.idColumn()).
+		selectField(s.recordChecksum()).
+		from(s.table()).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryChecksums(ctx, s.DB, q)
+}
+
+// recordChecksum hashes the UTF-8 text of the fields like CRC32(CONCAT_WS(...)) in MySQL
+func (s PostgresDataSource) recordChecksum() string {
+	fields := make([]string, len(s.ChecksumFields))
+	for i, f := range s.ChecksumFields {
+		fields[i] = pq.QuoteIdentifier(f)
+	}
+	return fmt.Sprintf("crc32(convert_to(concat_ws('|', %s), 'UTF8'))", strings.Join(fields, ", "))
+}
+
+func (s PostgresDataSource) selectChecksum(q *query) {
+	if s.ChecksumsEnabled() {
+		q.selectField(fmt.Sprintf(`bit_xor(%s) AS "checksum"`, s.recordChecksum()))
+	}
+}
+
+// binKey floors the ID to a multiple of the interval, dividing as numeric so negative IDs round down
+func (s PostgresDataSource) binKey(interval int64) string {
+	return fmt.Sprintf(
+		`(FLOOR(%[1]s / %[2]d::numeric) * %[2]d)::bigint AS "bin_key"`,
+		s.idColumn(), interval)
+}
+
+// idColumn renders the key of the ID column. Unsigned IDs are offset by 2^63 as numeric, which maps them
+// onto their keys like UnsignedKey.
+func (s PostgresDataSource) idColumn() string {
+	if s.Unsigned {
+		return fmt.Sprintf("(%s - 9223372036854775808)::bigint", pq.QuoteIdentifier(s.FieldName))
+	}
+	return pq.QuoteIdentifier(s.FieldName)
+}
+
+func (s PostgresDataSource) rangeConditions(gte, lt int64) []string {
+	field := pq.QuoteIdentifier(s.FieldName)
+	return []string{
+		fmt.Sprintf("%s >= %s", field, FormatID(gte, s.Unsigned)),
+		fmt.Sprintf("%s < %s", field, FormatID(lt, s.Unsigned)),
+	}
+}
+
+// table quotes every part of a possibly schema-qualified table name
+func (s PostgresDataSource) table() string {
+	parts := strings.Split(s.Tablename, ".")
+	for i, p := range parts {
+		parts[i] = pq.QuoteIdentifier(p)
+	}
+	return strings.Join(parts, ".")
+}
+
+var _ DataSource = PostgresDataSource{}
+var _ RecordFetcher = PostgresDataSource{}
+var _ RecordReader = PostgresDataSource{}
+var _ Checksummer = PostgresDataSource{}
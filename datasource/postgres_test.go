@@ -0,0 +1,154 @@
+package datasource
+
+import (
+	"context"
+	"database/sql/driver"
+	"math"
+	"reflect"
+	"testing"
+
+	"github.com/arturom/datadiff/histogram"
+)
+
+func TestPostgresFetchHistogramRange(t *testing.T) {
+	stub, db := newSQLStub(t)
+	s := PostgresDataSource{DB: db, Tablename: "sales.Orders", FieldName: "OrderID", Conditions: []string{`"deleted" = false`}}
+
+	// Dividing as numeric floors negative IDs to the bin below, where integer division would truncate toward zero
+	stub.answer(
+		`SELECT "OrderID" - ("OrderID" - (-20)) % 10 AS "bin_key", COUNT(*) AS "count" FROM "sales"."Orders" WHERE "OrderID" >= -20 AND "OrderID" < 20 AND "deleted" = false GROUP BY "bin_key"`,
+		[]string{"bin_key", "count"},
+		[]driver.Value{int64(-20), int64(4)},
+		[]driver.Value{int64(-10), int64(10)},
+		[]driver.Value{int64(10), int64(1)},
+	)
+	got, err := s.FetchHistogramRange(context.Background(), -20, 20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := histogram.Histogram{
+		Bins:        histogram.Bins{{Key: -20, Count: 4}, {Key: -10, Count: 10}, {Key: 10, Count: 1}},
+		BinCapacity: 10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestPostgresFetchHistogramAll(t *testing.T) {
+	stub, db := newSQLStub(t)
+	s := PostgresDataSource{DB: db, Tablename: "orders", FieldName: "id"}
+	stub.answer(
+		`SELECT (FLOOR("id" / 1000::numeric) * 1000)::bigint AS "bin_key", COUNT(*) AS "count" FROM "orders" GROUP BY "bin_key"`,
+		[]string{"bin_key", "count"},
+		[]driver.Value{int64(-1000), int64(1)},
+	)
+	got, err := s.FetchHistogramAll(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (histogram.Bins{{Key: -1000, Count: 1}}); !reflect.DeepEqual(got.Bins, want) {
+		t.Errorf("got %v, want %v", got.Bins, want)
+	}
+}
+
+func TestPostgresTableQuoting(t *testing.T) {
+	tests := []struct {
+		table string
+		want  string
+	}{
+		{"orders", `"orders"`},
+		{"sales.Orders", `"sales"."Orders"`},
+		{`odd"schema.my table`, `"odd""schema"."my table"`},
+	}
+	for _, tt := range tests {
+		if got := (PostgresDataSource{Tablename: tt.table}).table(); got != tt.want {
+			t.Errorf("table(%q) = %s, want %s", tt.table, got, tt.want)
+		}
+	}
+}
+
+func TestPostgresFetchIDRange(t *testing.T) {
+	stub, db := newSQLStub(t)
+	s := PostgresDataSource{DB: db, Tablename: "public.orders", FieldName: "id"}
+	stub.answer(
+		`SELECT "id" FROM "public"."orders" WHERE "id" >= 5 AND "id" < 9`,
+		[]string{"id"},
+		[]driver.Value{int64(5)},
+		[]driver.Value{int64(8)},
+		[]driver.Value{int64(8)},
+	)
+	got, err := s.FetchIDRange(context.Background(), 5, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{5, 8, 8}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if n := len(stub.received()); n != 1 {
+		t.Errorf("got %d queries, want 1", n)
+	}
+}
+
+func TestPostgresChecksums(t *testing.T) {
+	stub, db := newSQLStub(t)
+	s := PostgresDataSource{DB: db, Tablename: "orders", FieldName: "id", ChecksumFields: []string{"email", "updated at"}}
+	stub.answer(
+		`SELECT "id" - ("id" - 0) % 10 AS "bin_key", COUNT(*) AS "count", bit_xor(crc32(convert_to(concat_ws('|', "email", "updated at"), 'UTF8'))) AS "checksum" FROM "orders" WHERE "id" >= 0 AND "id" < 20 GROUP BY "bin_key"`,
+		[]string{"bin_key", "count", "checksum"},
+		[]driver.Value{int64(0), int64(2), int64(4294967295)},
+	)
+	got, err := s.FetchHistogramRange(context.Background(), 0, 20, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (histogram.Bins{{Key: 0, Count: 2, Checksum: 4294967295}}); !reflect.DeepEqual(got.Bins, want) {
+		t.Errorf("got %v, want %v", got.Bins, want)
+	}
+
+	stub.answer(
+		`SELECT "id", crc32(convert_to(concat_ws('|', "email", "updated at"), 'UTF8')) FROM "orders" WHERE "id" >= 0 AND "id" < 10`,
+		[]string{"id", "crc32"},
+		[]driver.Value{int64(3), int64(12345)},
+	)
+	checksums, err := s.FetchChecksumRange(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[int64]uint32{3: 12345}; !reflect.DeepEqual(checksums, want) {
+		t.Errorf("got %v, want %v", checksums, want)
+	}
+}
+
+func TestPostgresUnsignedIDs(t *testing.T) {
+	stub, db := newSQLStub(t)
+	s := PostgresDataSource{DB: db, Tablename: "orders", FieldName: "id", Unsigned: true}
+
+	// The NUMERIC column is offset by 2^63 into the keys, and compared to the IDs of the range
+	stub.answer(
+		`SELECT ("id" - 9223372036854775808)::bigint FROM "orders" WHERE "id" >= 9223372036854775808 AND "id" < 18446744073709551615`,
+		[]string{"int8"},
+		[]driver.Value{int64(0)},
+		[]driver.Value{int64(9223372036854775806)},
+	)
+	got, err := s.FetchIDRange(context.Background(), 0, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{0, 9223372036854775806}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	stub.answer(
+		`SELECT (FLOOR(("id" - 9223372036854775808)::bigint / 1000::numeric) * 1000)::bigint AS "bin_key", COUNT(*) AS "count" FROM "orders" GROUP BY "bin_key"`,
+		[]string{"bin_key", "count"},
+		[]driver.Value{int64(-9223372036854775808), int64(1)},
+	)
+	hist, err := s.FetchHistogramAll(context.Background(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (histogram.Bins{{Key: math.MinInt64, Count: 1}}); !reflect.DeepEqual(hist.Bins, want) {
+		t.Errorf("got %v, want %v", hist.Bins, want)
+	}
+}
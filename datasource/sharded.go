@@ -0,0 +1,327 @@
+package datasource
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/arturom/datadiff/histogram"
+)
+
+// Shard is a member of a sharded data source. Routing limits the shard to the IDs in [Gte, Lt),
+// so that it is never queried for ranges outside of them.
+type Shard struct {
+	Source DataSource
+	Gte    int64
+	Lt     int64
+}
+
+// ShardedDataSource treats several data sources, such as the tables or indices a data set is split
+// across, as a single one. Queries are fanned out to the shards, histograms are summed and IDs unioned.
+// It implements Checksummer, RecordFetcher and RecordReader whatever its shards support, and reports
+// what every shard supports through ChecksumsEnabled, FetchesRecords and ReadsRecords.
+type ShardedDataSource struct {
+	Shards []Shard
+	slots  chan struct{}
+}
+
+// DefaultShardConcurrency is the number of shards queried at once when no concurrency is given
+const DefaultShardConcurrency = 4
+
+// NewShardedDataSource creates a sharded data source running at most concurrency shard queries at once,
+// or DefaultShardConcurrency when concurrency is zero
+func NewShardedDataSource(shards []Shard, concurrency int) ShardedDataSource {
+	if concurrency < 1 {
+		concurrency = DefaultShardConcurrency
+	}
+	return ShardedDataSource{
+		Shards: shards,
+		slots:  make(chan struct{}, concurrency),
+	}
+}
+
+// fanOut runs a query against every shard overlapping [gte, lt) concurrently, with the range clamped to the
+// shard's, and returns the first error. Shards outside of the range are skipped.
+func (s ShardedDataSource) fanOut(ctx context.Context, gte, lt int64, query func(ctx context.Context, shard Shard, gte, lt int64) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	for _, shard := range s.Shards {
+		from, to := max(gte, shard.Gte), min(lt, shard.Lt)
+		if from >= to {
+			continue
+		}
+		shard := shard
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case s.slots <- struct{}{}:
+			case <-ctx.Done():
+				fail(ctx.Err())
+				return
+			}
+			err := query(ctx, shard, from, to)
+			<-s.slots
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (s ShardedDataSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	return s.histogram(ctx, math.MinInt64, math.MaxInt64, interval, func(ctx context.Context, shard Shard, gte, lt int64) (histogram.Histogram, error) {
+		// Unrouted shards are not limited to a range, so they can answer for all of their IDs
+		if gte == math.MinInt64 && lt == math.MaxInt64 {
+			return shard.Source.FetchHistogramAll(ctx, interval)
+		}
+		return shardHistogramRange(ctx, shard.Source, gte, lt, 0, interval)
+	})
+}
+
+// FetchHistogramRange sums the counts of the bins with the same key across shards. Checksums are combined
+// with XOR, like the checksums of the records within a bin.
+func (s ShardedDataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	return s.histogram(ctx, gte, lt, interval, func(ctx context.Context, shard Shard, from, to int64) (histogram.Histogram, error) {
+		return shardHistogramRange(ctx, shard.Source, from, to, gte, interval)
+	})
+}
+
+// shardHistogramRange bins the IDs of a shard in [gte, lt) from origin rather than from gte, which differ when
+// the shard starts past the origin. The IDs before the first bin boundary are fetched as a bin of their own.
+func shardHistogramRange(ctx context.Context, source DataSource, gte, lt, origin, interval int64) (histogram.Histogram, error) {
+	key := binStart(gte, origin, interval)
+	boundary := nextBinStart(gte, origin, interval)
+	if boundary == gte {
+		return source.FetchHistogramRange(ctx, gte, lt, interval)
+	}
+
+	h, err := source.FetchHistogramRange(ctx, gte, min(boundary, lt), interval)
+	if err != nil || boundary >= lt {
+		return rekey(h, key), err
+	}
+	rest, err := source.FetchHistogramRange(ctx, boundary, lt, interval)
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+	h = rekey(h, key)
+	h.Bins = append(h.Bins, rest.Bins...)
+	return h, nil
+}
+
+// rekey gives the single bin of a histogram shorter than its interval the given key
+func rekey(h histogram.Histogram, key int64) histogram.Histogram {
+	for i := range h.Bins {
+		h.Bins[i].Key = key
+	}
+	return h
+}
+
+// histogram fans a histogram query out to the shards overlapping [gte, lt) and sums their bins
+func (s ShardedDataSource) histogram(ctx context.Context, gte, lt, interval int64, query func(ctx context.Context, shard Shard, gte, lt int64) (histogram.Histogram, error)) (histogram.Histogram, error) {
+	var mu sync.Mutex
+	bins := make(map[int64]*histogram.Bin)
+	err := s.fanOut(ctx, gte, lt, func(ctx context.Context, shard Shard, gte, lt int64) error {
+		h, err := query(ctx, shard, gte, lt)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, bin := range h.Bins {
+			b, ok := bins[bin.Key]
+			if !ok {
+				b = &histogram.Bin{Key: bin.Key}
+				bins[bin.Key] = b
+			}
+			b.Count += bin.Count
+			b.Checksum ^= bin.Checksum
+		}
+		return nil
+	})
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+
+	h := histogram.Histogram{
+		Bins:        make(histogram.Bins, 0, len(bins)),
+		BinCapacity: interval,
+	}
+	for _, b := range bins {
+		h.Bins = append(h.Bins, *b)
+	}
+	h.Sort()
+	return h, nil
+}
+
+// FetchIDRange unions the IDs of the shards. An ID held by several shards is returned once per shard
+// so that it is reported as a duplicate.
+func (s ShardedDataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	var mu sync.Mutex
+	var ids []int64
+	err := s.fanOut(ctx, gte, lt, func(ctx context.Context, shard Shard, gte, lt int64) error {
+		shardIDs, err := shard.Source.FetchIDRange(ctx, gte, lt)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		ids = append(ids, shardIDs...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids, nil
+}
+
+// ChecksumsEnabled returns true if every shard implements Checksummer and has checksums enabled
+func (s ShardedDataSource) ChecksumsEnabled() bool {
+	for _, shard := range s.Shards {
+		c, ok := shard.Source.(Checksummer)
+		if !ok || !c.ChecksumsEnabled() {
+			return false
+		}
+	}
+	return len(s.Shards) != 0
+}
+
+// ChecksumEngine returns the engine of the shards, or nothing when they differ
+func (s ShardedDataSource) ChecksumEngine() string {
+	engine := ""
+	for i, shard := range s.Shards {
+		c, ok := shard.Source.(Checksummer)
+		if !ok || (i > 0 && c.ChecksumEngine() != engine) {
+			return ""
+		}
+		engine = c.ChecksumEngine()
+	}
+	return engine
+}
+
+func (s ShardedDataSource) FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error) {
+	var mu sync.Mutex
+	checksums := make(map[int64]uint32)
+	err := s.fanOut(ctx, gte, lt, func(ctx context.Context, shard Shard, gte, lt int64) error {
+		c, ok := shard.Source.(Checksummer)
+		if !ok {
+			return fmt.Errorf("Shard does not support checksums")
+		}
+		shardChecksums, err := c.FetchChecksumRange(ctx, gte, lt)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for id, checksum := range shardChecksums {
+			checksums[id] = checksum
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return checksums, nil
+}
+
+// FetchesRecords returns true if every shard implements RecordFetcher
+func (s ShardedDataSource) FetchesRecords() bool {
+	for _, shard := range s.Shards {
+		if !FetchesRecords(shard.Source) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s ShardedDataSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error) {
+	var mu sync.Mutex
+	records := make(map[int64]Record)
+	err := s.fanOut(ctx, gte, lt, func(ctx context.Context, shard Shard, gte, lt int64) error {
+		f, ok := shard.Source.(RecordFetcher)
+		if !ok {
+			return fmt.Errorf("Shard does not support fetching records")
+		}
+		shardRecords, err := f.FetchRecordRange(ctx, gte, lt, fields)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for id, record := range shardRecords {
+			records[id] = record
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// ReadsRecords returns true if every shard implements RecordReader
+func (s ShardedDataSource) ReadsRecords() bool {
+	for _, shard := range s.Shards {
+		if !ReadsRecords(shard.Source) {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadRecords reads every ID from the shards whose range holds it
+func (s ShardedDataSource) ReadRecords(ctx context.Context, ids []int64) (map[int64]Record, error) {
+	var mu sync.Mutex
+	records := make(map[int64]Record)
+	err := s.fanOut(ctx, math.MinInt64, math.MaxInt64, func(ctx context.Context, shard Shard, gte, lt int64) error {
+		var routed []int64
+		for _, id := range ids {
+			if id >= gte && id < lt {
+				routed = append(routed, id)
+			}
+		}
+		if len(routed) == 0 {
+			return nil
+		}
+		r, ok := shard.Source.(RecordReader)
+		if !ok {
+			return fmt.Errorf("Shard does not support reading records")
+		}
+		shardRecords, err := r.ReadRecords(ctx, routed)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for id, record := range shardRecords {
+			records[id] = record
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+var _ DataSource = ShardedDataSource{}
+var _ Checksummer = ShardedDataSource{}
+var _ RecordFetcher = ShardedDataSource{}
+var _ RecordReader = ShardedDataSource{}
@@ -0,0 +1,226 @@
+package datasource
+
+import (
+	"context"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/arturom/datadiff/histogram"
+)
+
+// countingSource serves a list of IDs, in order for its histograms, and records the most queries it ran at once
+type countingSource struct {
+	ids []int64
+
+	mu       sync.Mutex
+	inFlight int
+	peak     int
+}
+
+func (c *countingSource) enter() {
+	c.mu.Lock()
+	c.inFlight++
+	c.peak = max(c.peak, c.inFlight)
+	c.mu.Unlock()
+	time.Sleep(5 * time.Millisecond)
+}
+
+func (c *countingSource) leave() {
+	c.mu.Lock()
+	c.inFlight--
+	c.mu.Unlock()
+}
+
+func (c *countingSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	return c.histogram(ctx, math.MinInt64, math.MaxInt64, 0, interval)
+}
+
+func (c *countingSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	return c.histogram(ctx, gte, lt, gte, interval)
+}
+
+func (c *countingSource) histogram(ctx context.Context, gte, lt, origin, interval int64) (histogram.Histogram, error) {
+	ids, _ := c.FetchIDRange(ctx, gte, lt)
+	h := histogram.Histogram{Bins: histogram.Bins{}, BinCapacity: interval}
+	for _, id := range ids {
+		key := binStart(id, origin, interval)
+		if len(h.Bins) == 0 || h.Bins[len(h.Bins)-1].Key != key {
+			h.Bins = append(h.Bins, histogram.Bin{Key: key})
+		}
+		h.Bins[len(h.Bins)-1].Count++
+	}
+	return h, nil
+}
+
+func (c *countingSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	c.enter()
+	defer c.leave()
+	ids := []int64{}
+	for _, id := range c.ids {
+		if id >= gte && id < lt {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func TestShardedDataSourceCapabilities(t *testing.T) {
+	all := Shard{Source: SqliteDataSource{ChecksumFields: []string{"name"}}, Gte: math.MinInt64, Lt: math.MaxInt64}
+	fetcher := Shard{Source: &MongoDataSource{}, Gte: math.MinInt64, Lt: math.MaxInt64}
+	none := Shard{Source: &countingSource{}, Gte: math.MinInt64, Lt: math.MaxInt64}
+	tests := []struct {
+		name                       string
+		shards                     []Shard
+		checksums, fetcher, reader bool
+	}{
+		{"all", []Shard{all, all}, true, true, true},
+		{"fetcher", []Shard{all, fetcher}, false, true, false},
+		{"none", []Shard{all, fetcher, none}, false, false, false},
+	}
+	for _, tt := range tests {
+		s := NewShardedDataSource(tt.shards, 0)
+		if got := s.ChecksumsEnabled(); got != tt.checksums {
+			t.Errorf("%s: checksums enabled %t, want %t", tt.name, got, tt.checksums)
+		}
+		if got := s.ChecksumEngine(); (got == "sqlite") != tt.checksums {
+			t.Errorf("%s: checksum engine %q, want sqlite only when every shard checksums", tt.name, got)
+		}
+		if got := FetchesRecords(s); got != tt.fetcher {
+			t.Errorf("%s: fetches records %t, want %t", tt.name, got, tt.fetcher)
+		}
+		if got := ReadsRecords(s); got != tt.reader {
+			t.Errorf("%s: reads records %t, want %t", tt.name, got, tt.reader)
+		}
+	}
+}
+
+func TestShardedDataSourceReadsMixedShards(t *testing.T) {
+	low := Shard{Source: SqliteDataSource{}, Gte: math.MinInt64, Lt: 10}
+	high := Shard{Source: &countingSource{}, Gte: 10, Lt: math.MaxInt64}
+	s := NewShardedDataSource([]Shard{low, high}, 0)
+
+	// IDs routed to the shard lacking RecordReader fail rather than being left out
+	_, err := s.ReadRecords(context.Background(), []int64{12})
+	if err == nil || !strings.Contains(err.Error(), "Shard does not support reading records") {
+		t.Errorf("got error %v, want the shard refused", err)
+	}
+	records, err := s.ReadRecords(context.Background(), nil)
+	if err != nil || len(records) != 0 {
+		t.Errorf("got %v and error %v, want no records", records, err)
+	}
+}
+
+func TestShardedDataSourceMergesShards(t *testing.T) {
+	low := &countingSource{ids: []int64{-5, 1, 2, 12}}
+	high := &countingSource{ids: []int64{12, 15, 40}}
+	s := NewShardedDataSource([]Shard{
+		{Source: low, Gte: math.MinInt64, Lt: 13},
+		{Source: high, Gte: 12, Lt: math.MaxInt64},
+	}, 0)
+
+	got, err := s.FetchHistogramAll(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := histogram.Histogram{
+		Bins:        histogram.Bins{{Key: -10, Count: 1}, {Key: 0, Count: 2}, {Key: 10, Count: 3}, {Key: 40, Count: 1}},
+		BinCapacity: 10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// The bins of a range start at its lower bound, also in the shards starting past it
+	got, err = s.FetchHistogramRange(context.Background(), 1, 41, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = histogram.Histogram{
+		Bins:        histogram.Bins{{Key: 1, Count: 2}, {Key: 11, Count: 3}, {Key: 31, Count: 1}},
+		BinCapacity: 10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// ID 12 is held by both shards, so it is returned twice to be reported as a duplicate
+	ids, err := s.FetchIDRange(context.Background(), 0, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 2, 12, 12, 15}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+
+	// Only the shards overlapping the range are queried
+	high.ids = append(high.ids, 5)
+	ids, err = s.FetchIDRange(context.Background(), 0, 12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int64{1, 2}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %v, want %v", ids, want)
+	}
+}
+
+func TestShardedDataSourceDefaultConcurrency(t *testing.T) {
+	c := &countingSource{ids: []int64{1}}
+	shards := make([]Shard, 3*DefaultShardConcurrency)
+	for i := range shards {
+		shards[i] = Shard{Source: c, Gte: math.MinInt64, Lt: math.MaxInt64}
+	}
+	_, err := NewShardedDataSource(shards, 0).FetchIDRange(context.Background(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.peak > DefaultShardConcurrency {
+		t.Errorf("queried %d shards at once, want at most %d", c.peak, DefaultShardConcurrency)
+	}
+	if c.peak < 2 {
+		t.Errorf("queried %d shards at once, want them queried concurrently", c.peak)
+	}
+}
+
+func TestShardedSourceOfUnsignedIDs(t *testing.T) {
+	dir := t.TempDir()
+	low, high := filepath.Join(dir, "low.txt"), filepath.Join(dir, "high.txt")
+	err := os.WriteFile(low, []byte("3\n9223372036854775807\n"), 0o600)
+	if err == nil {
+		err = os.WriteFile(high, []byte("9223372036854775808\n18446744073709551614\n"), 0o600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Shard bounds are unsigned IDs too, the high shard holding the IDs from 2^63
+	f := DataSourceFactory{Unsigned: true}
+	s, err := f.Create("sharded", "", `{"shards":[
+		{"driver":"file","conn":"`+low+`","lt":9223372036854775808},
+		{"driver":"file","conn":"`+high+`","gte":9223372036854775808}
+	]}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.FetchIDRange(context.Background(), math.MinInt64, math.MaxInt64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{UnsignedKey(3), UnsignedKey(1<<63 - 1), UnsignedKey(1 << 63), UnsignedKey(math.MaxUint64 - 1)}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Drivers reading signed IDs only refuse the option
+	for _, driver := range []string{"sqlite", "mongodb", "es0"} {
+		_, err := f.Create(driver, "", "{}")
+		if err == nil || !strings.Contains(err.Error(), "Unsigned IDs are not supported by the "+driver+" driver") {
+			t.Errorf("%s: got error %v, want unsigned IDs refused", driver, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/crc32"
+	"strings"
+
+	"github.com/arturom/datadiff/histogram"
+	"github.com/mattn/go-sqlite3"
+)
+
+// SqliteDriverName is the sql driver registered with the CRC32 and BIT_XOR functions that MySQL provides
+const SqliteDriverName = "sqlite3_datadiff"
+
+func init() {
+	sql.Register(SqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			err := conn.RegisterFunc("crc32", func(s string) int64 {
+				return int64(crc32.ChecksumIEEE([]byte(s)))
+			}, true)
+			if err != nil {
+				return err
+			}
+			return conn.RegisterAggregator("bit_xor", newBitXor, true)
+		},
+	})
+}
+
+type bitXor struct {
+	value int64
+}
+
+func newBitXor() *bitXor {
+	return &bitXor{}
+}
+
+func (x *bitXor) Step(v int64) {
+	x.value ^= v
+}
+
+func (x *bitXor) Done() int64 {
+	return x.value
+}
+
+// SqliteDataSource uses a table in a SQLite database file to implement the datasource interface
+type SqliteDataSource struct {
+	DB         *sql.DB
+	Tablename  string
+	FieldName  string
+	Conditions []string
+	// ChecksumFields are the columns compared when checking records for modifications
+	ChecksumFields []string
+}
+
+func (s SqliteDataSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	q := &query{}
+	q.selectField(s.binKey(interval)).
+		selectField(`COUNT(*) AS "count"`).
+		from(quoteSqliteIdentifier(s.Tablename)).
+		where(s.Conditions...).
+		group(`"bin_key"`)
+	s.selectChecksum(q)
+
+	return queryHistogram(ctx, s.DB, q, interval, s.ChecksumsEnabled())
+}
+
+func (s SqliteDataSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	q := &query{}
+	q.selectField(sqlBinKey(quoteSqliteIdentifier(s.FieldName), gte, interval) + ` AS "bin_key"`).
+		selectField(`COUNT(*) AS "count"`).
+		from(quoteSqliteIdentifier(s.Tablename)).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...).
+		group(`"bin_key"`)
+	s.selectChecksum(q)
+
+	return queryHistogram(ctx, s.DB, q, interval, s.ChecksumsEnabled())
+}
+
+func (s SqliteDataSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	q := query{}
+	q.selectField(quoteSqliteIdentifier(s.FieldName)).
+		from(quoteSqliteIdentifier(s.Tablename)).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryIDs(ctx, s.DB, q)
+}
+
+func (s SqliteDataSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]Record, error) {
+	q := query{}
+	q.selectField(quoteSqliteIdentifier(s.FieldName))
+	for _, f := range fields {
+		q.selectField(quoteSqliteIdentifier(f))
+	}
+	q.from(quoteSqliteIdentifier(s.Tablename)).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryRecords(ctx, s.DB, q, fields)
+}
+
+func (s SqliteDataSource) ReadRecords(ctx context.Context, ids []int64) (map[int64]Record, error) {
+	q := query{}
+	q.selectField("*").
+		from(quoteSqliteIdentifier(s.Tablename)).
+		where(fmt.Sprintf("%s IN (%s)", quoteSqliteIdentifier(s.FieldName), joinIDs(ids, false))).
+		where(s.Conditions...)
+
+	return queryRows(ctx, s.DB, q, s.FieldName, false)
+}
+
+func (s SqliteDataSource) ChecksumsEnabled() bool {
+	return len(s.ChecksumFields) != 0
+}
+
+func (s SqliteDataSource) ChecksumEngine() string {
+	return "sqlite"
+}
+
+func (s SqliteDataSource) FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error) {
+	if !s.ChecksumsEnabled() {
+		return nil, fmt.Errorf("No checksum fields configured for table %s", s.Tablename)
+	}
+	q := query{}
+	q.selectField(quoteSqliteIdentifier(s.FieldName)).
+		selectField(s.recordChecksum()).
+		from(quoteSqliteIdentifier(s.Tablename)).
+		where(s.rangeConditions(gte, lt)...).
+		where(s.Conditions...)
+
+	return queryChecksums(ctx, s.DB, q)
+}
+
+// recordChecksum mirrors the MySQL expression using the functions registered on SqliteDriverName
+func (s SqliteDataSource) recordChecksum() string {
+	fields := make([]string, len(s.ChecksumFields))
+	for i, f := range s.ChecksumFields {
+		fields[i] = quoteSqliteIdentifier(f)
+	}
+	return fmt.Sprintf("crc32(concat_ws('|', %s))", strings.Join(fields, ", "))
+}
+
+func (s SqliteDataSource) selectChecksum(q *query) {
+	if s.ChecksumsEnabled() {
+		q.selectField(fmt.Sprintf(`bit_xor(%s) AS "checksum"`, s.recordChecksum()))
+	}
+}
+
+// binKey floors the ID to a multiple of the interval using integer arithmetic only,
+// since SQLite division truncates towards zero and REAL division loses precision
+func (s SqliteDataSource) binKey(interval int64) string {
+	return fmt.Sprintf(
+		`%[1]s - ((%[1]s %% %[2]d) + %[2]d) %% %[2]d AS "bin_key"`,
+		quoteSqliteIdentifier(s.FieldName), interval)
+}
+
+func (s SqliteDataSource) rangeConditions(gte, lt int64) []string {
+	field := quoteSqliteIdentifier(s.FieldName)
+	return []string{
+		fmt.Sprintf("%s >= %d", field, gte),
+		fmt.Sprintf("%s < %d", field, lt),
+	}
+}
+
+func quoteSqliteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+var _ DataSource = SqliteDataSource{}
+var _ Checksummer = SqliteDataSource{}
+var _ RecordFetcher = SqliteDataSource{}
+var _ RecordReader = SqliteDataSource{}
@@ -0,0 +1,127 @@
+package datasource
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+)
+
+// sqlStub stands in for a database server, recording the queries it receives and answering them with
+// the rows given for each. It checks the SQL the sources generate where no server is available.
+type sqlStub struct {
+	mu      sync.Mutex
+	queries []string
+	results map[string]stubResult
+}
+
+type stubResult struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+var (
+	stubsMu sync.Mutex
+	stubs   = make(map[string]*sqlStub)
+)
+
+func init() {
+	sql.Register("sqlstub", stubDriver{})
+}
+
+// newSQLStub opens a database answered by a new stub
+func newSQLStub(t *testing.T) (*sqlStub, *sql.DB) {
+	stub := &sqlStub{results: make(map[string]stubResult)}
+	stubsMu.Lock()
+	stubs[t.Name()] = stub
+	stubsMu.Unlock()
+	db, err := sql.Open("sqlstub", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		stubsMu.Lock()
+		delete(stubs, t.Name())
+		stubsMu.Unlock()
+	})
+	return stub, db
+}
+
+// answer sets the rows returned for a query
+func (s *sqlStub) answer(query string, columns []string, rows ...[]driver.Value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[query] = stubResult{columns: columns, rows: rows}
+}
+
+// received returns the queries run so far
+func (s *sqlStub) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.queries...)
+}
+
+type stubDriver struct{}
+
+func (stubDriver) Open(name string) (driver.Conn, error) {
+	stubsMu.Lock()
+	defer stubsMu.Unlock()
+	stub, ok := stubs[name]
+	if !ok {
+		return nil, fmt.Errorf("no stub named %s", name)
+	}
+	return stubConn{stub}, nil
+}
+
+type stubConn struct {
+	stub *sqlStub
+}
+
+func (c stubConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepared statements are not supported")
+}
+
+func (c stubConn) Close() error {
+	return nil
+}
+
+func (c stubConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("transactions are not supported")
+}
+
+func (c stubConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.stub.mu.Lock()
+	defer c.stub.mu.Unlock()
+	c.stub.queries = append(c.stub.queries, query)
+	res, ok := c.stub.results[query]
+	if !ok {
+		return nil, fmt.Errorf("unexpected query: %s", query)
+	}
+	return &stubRows{result: res}, nil
+}
+
+type stubRows struct {
+	result stubResult
+	next   int
+}
+
+func (r *stubRows) Columns() []string {
+	return r.result.columns
+}
+
+func (r *stubRows) Close() error {
+	return nil
+}
+
+func (r *stubRows) Next(dest []driver.Value) error {
+	if r.next == len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
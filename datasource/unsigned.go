@@ -0,0 +1,44 @@
+package datasource
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Unsigned IDs are compared as int64 keys. Flipping the sign bit maps [0, 2^64) onto [-2^63, 2^63)
+// in order, so histograms, ranges and sorting work on keys exactly as they do on signed IDs.
+
+// UnsignedKey maps an unsigned ID onto its key
+func UnsignedKey(id uint64) int64 {
+	return int64(id ^ 1<<63)
+}
+
+// UnsignedID maps a key back onto its unsigned ID
+func UnsignedID(key int64) uint64 {
+	return uint64(key) ^ 1<<63
+}
+
+// FormatID renders the ID of a key in base 10
+func FormatID(key int64, unsigned bool) string {
+	if unsigned {
+		return strconv.FormatUint(UnsignedID(key), 10)
+	}
+	return strconv.FormatInt(key, 10)
+}
+
+// ParseID parses an ID given in base 10 into its key
+func ParseID(s string, unsigned bool) (int64, error) {
+	if !unsigned {
+		return strconv.ParseInt(s, 10, 64)
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return UnsignedKey(id), nil
+}
+
+// errUnsigned is returned by the drivers that only read signed IDs
+func errUnsigned(driver string) error {
+	return fmt.Errorf("Unsigned IDs are not supported by the %s driver", driver)
+}
@@ -0,0 +1,120 @@
+package histogram
+
+import (
+	"math"
+	"sort"
+)
+
+// MultiBin describes the counts of records from any number of data sources for the same range.
+// Counts and checksums are indexed by the position of the source's histogram given to MergeAll.
+type MultiBin struct {
+	Key int64
+	// Gte and Lt delimit the range [Gte, Lt) of IDs the bin holds, which is narrower than the interval
+	// for the bins cut short by the range the histograms were fetched for
+	Gte       int64
+	Lt        int64
+	Counts    []int64
+	Checksums []uint32
+}
+
+// Capacity returns the number of IDs in the range of the bin
+func (b MultiBin) Capacity() int64 {
+	return b.Lt - b.Gte
+}
+
+// IsFull returns true if the bin is filled to capacity in every source
+func (b MultiBin) IsFull() bool {
+	for _, c := range b.Counts {
+		if c != b.Capacity() {
+			return false
+		}
+	}
+	return true
+}
+
+// OverCapacity returns the indexes of the sources counting more records than the bin has IDs,
+// which can only happen when they hold duplicate IDs
+func (b MultiBin) OverCapacity() []int {
+	var sources []int
+	for i, c := range b.Counts {
+		if c > b.Capacity() {
+			sources = append(sources, i)
+		}
+	}
+	return sources
+}
+
+// ChecksumsMatch returns true if the records in every source have the same content
+func (b MultiBin) ChecksumsMatch() bool {
+	for _, c := range b.Checksums {
+		if c != b.Checksums[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// MultiBinsMap describes a map of multi bins where the keys are the bin keys
+type MultiBinsMap map[int64]*MultiBin
+
+// MultiMergedHistogram is a structure composed of MultiBinsMap and the bin capacity
+type MultiMergedHistogram struct {
+	Bins        MultiBinsMap
+	BinCapacity int64
+}
+
+// MergeAll combines the histograms of any number of sources fetched for the range [gte, lt). The range of
+// every bin is clamped to it, since the first and last bins may extend past it. A bin missing from a
+// histogram counts zero records.
+func MergeAll(gte, lt int64, hs ...Histogram) MultiMergedHistogram {
+	var capacity int64
+	if len(hs) != 0 {
+		capacity = hs[0].BinCapacity
+	}
+
+	m := make(MultiBinsMap)
+	for i, h := range hs {
+		for _, bin := range h.Bins {
+			b, ok := m[bin.Key]
+			if !ok {
+				b = &MultiBin{
+					Key:       bin.Key,
+					Gte:       max(bin.Key, gte),
+					Lt:        min(binEnd(bin.Key, capacity), lt),
+					Counts:    make([]int64, len(hs)),
+					Checksums: make([]uint32, len(hs)),
+				}
+				m[bin.Key] = b
+			}
+			b.Counts[i] = bin.Count
+			b.Checksums[i] = bin.Checksum
+		}
+	}
+
+	return MultiMergedHistogram{
+		Bins:        m,
+		BinCapacity: capacity,
+	}
+}
+
+// binEnd returns the end of the range of a bin, saturating instead of overflowing for the bins holding the largest IDs
+func binEnd(key, interval int64) int64 {
+	if key > math.MaxInt64-interval {
+		return math.MaxInt64
+	}
+	return key + interval
+}
+
+// UnresolvedBins returns the bins that are not filled to capacity in every source or whose checksums differ, sorted by key
+func (h MultiMergedHistogram) UnresolvedBins() []MultiBin {
+	var s []MultiBin
+	for _, b := range h.Bins {
+		if !b.IsFull() || !b.ChecksumsMatch() {
+			s = append(s, *b)
+		}
+	}
+	sort.Slice(s, func(i, j int) bool {
+		return s[i].Key < s[j].Key
+	})
+	return s
+}
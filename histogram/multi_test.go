@@ -0,0 +1,64 @@
+package histogram
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestMergeAll(t *testing.T) {
+	m := MergeAll(math.MinInt64, math.MaxInt64,
+		Histogram{Bins: Bins{{Key: 0, Count: 10, Checksum: 7}, {Key: 10, Count: 10, Checksum: 1}, {Key: 20, Count: 4}}, BinCapacity: 10},
+		Histogram{Bins: Bins{{Key: 0, Count: 10, Checksum: 7}, {Key: 10, Count: 10, Checksum: 2}}, BinCapacity: 10},
+		Histogram{Bins: Bins{{Key: 0, Count: 10, Checksum: 7}, {Key: 10, Count: 10, Checksum: 1}, {Key: -10, Count: 12}}, BinCapacity: 10},
+	)
+	if m.BinCapacity != 10 {
+		t.Errorf("got capacity %d, want 10", m.BinCapacity)
+	}
+
+	// A bin missing from a histogram counts zero records in that source
+	want := []MultiBin{
+		{Key: -10, Gte: -10, Lt: 0, Counts: []int64{0, 0, 12}, Checksums: []uint32{0, 0, 0}},
+		{Key: 10, Gte: 10, Lt: 20, Counts: []int64{10, 10, 10}, Checksums: []uint32{1, 2, 1}},
+		{Key: 20, Gte: 20, Lt: 30, Counts: []int64{4, 0, 0}, Checksums: []uint32{0, 0, 0}},
+	}
+	got := m.UnresolvedBins()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if over := got[0].OverCapacity(); !reflect.DeepEqual(over, []int{2}) {
+		t.Errorf("got sources %v over capacity, want [2]", over)
+	}
+	if over := got[1].OverCapacity(); len(over) != 0 {
+		t.Errorf("got sources %v over capacity, want none", over)
+	}
+}
+
+func TestMergeAllClampsBinsToTheRange(t *testing.T) {
+	// The range cuts the first and last bins short, so they are full with fewer records
+	m := MergeAll(5, 23,
+		Histogram{Bins: Bins{{Key: 0, Count: 5}, {Key: 10, Count: 10}, {Key: 20, Count: 3}}, BinCapacity: 10},
+		Histogram{Bins: Bins{{Key: 0, Count: 5}, {Key: 10, Count: 9}, {Key: 20, Count: 3}}, BinCapacity: 10},
+	)
+	want := []MultiBin{{Key: 10, Gte: 10, Lt: 20, Counts: []int64{10, 9}, Checksums: []uint32{0, 0}}}
+	if got := m.UnresolvedBins(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if b := m.Bins[0]; b.Gte != 5 || b.Lt != 10 || !b.IsFull() {
+		t.Errorf("got bin %v, want [5, 10) filled to capacity", b)
+	}
+
+	// The bin holding the largest IDs ends at the largest ID instead of overflowing
+	m = MergeAll(math.MinInt64, math.MaxInt64, Histogram{Bins: Bins{{Key: math.MaxInt64 - 5, Count: 5}}, BinCapacity: 10})
+	if b := m.Bins[math.MaxInt64-5]; b.Lt != math.MaxInt64 || !b.IsFull() {
+		t.Errorf("got bin %v, want it to end at the largest ID", b)
+	}
+}
+
+func TestMergeAllOfNoHistograms(t *testing.T) {
+	m := MergeAll(math.MinInt64, math.MaxInt64)
+	if len(m.Bins) != 0 || m.BinCapacity != 0 || len(m.UnresolvedBins()) != 0 {
+		t.Errorf("got %v, want an empty histogram", m)
+	}
+}
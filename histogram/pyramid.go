@@ -0,0 +1,42 @@
+package histogram
+
+// Pyramid holds the histograms fetched from every source for a range, along with the pyramids
+// of the bins that were drilled into. Bins are kept sorted so that its JSON form is stable.
+type Pyramid struct {
+	// Histograms holds a histogram per source, in the order the sources are compared
+	Histograms []Histogram `json:"histograms"`
+	// Children maps the key of every bin drilled into to the pyramid of its range, or to nil
+	// when its IDs were compared directly
+	Children map[int64]*Pyramid `json:"children,omitempty"`
+}
+
+// NewPyramid creates a pyramid from the histograms of every source, sorting their bins
+func NewPyramid(hs ...Histogram) *Pyramid {
+	for _, h := range hs {
+		h.Sort()
+	}
+	return &Pyramid{
+		Histograms: hs,
+		Children:   make(map[int64]*Pyramid),
+	}
+}
+
+// Drilled returns true if the bin was drilled into, along with the pyramid of its range
+func (p *Pyramid) Drilled(key int64) (*Pyramid, bool) {
+	child, ok := p.Children[key]
+	return child, ok
+}
+
+// Unchanged returns true if every source holds the same count and checksum for the bin as in the pyramid
+func (p *Pyramid) Unchanged(bin MultiBin) bool {
+	if len(p.Histograms) != len(bin.Counts) {
+		return false
+	}
+	for i, h := range p.Histograms {
+		b := h.Find(bin.Key)
+		if b.Count != bin.Counts[i] || b.Checksum != bin.Checksums[i] {
+			return false
+		}
+	}
+	return true
+}
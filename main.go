@@ -1,10 +1,20 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/arturom/datadiff/datasource"
+	"github.com/arturom/datadiff/output"
 	"github.com/arturom/datadiff/processing"
+	"github.com/arturom/datadiff/repair"
 )
 
 func main() {
@@ -12,62 +22,336 @@ func main() {
 	o := cliOpts{}
 	o.parseFlags()
 
-	interval := *o.initialInterval
-	if interval != 10 && interval != 100 && interval != 1000 && interval != 10000 {
-		panic("Interval must be a multiple of 10 between 10 and 10,000")
+	if *o.initialInterval < 1 {
+		panic("Interval must be a positive integer")
+	}
+	if *o.branchingFactor < 2 {
+		panic("Branching factor must be at least 2")
+	}
+
+	// Parse the field mapping used to compare records
+	var fields []processing.FieldMapping
+	if *o.fields != "" {
+		err := json.Unmarshal([]byte(*o.fields), &fields)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	// Initialize datasource factory
-	f := datasource.DataSourceFactory{}
+	f := datasource.DataSourceFactory{Unsigned: *o.unsigned}
+
+	// Initialize the primary and secondary data sources, or every source of an N-way comparison
+	var primary, secondary datasource.DataSource
+	var sources []processing.Source
+	var err error
+	if *o.sources != "" {
+		if o.command == "sync" || *o.repair != "" {
+			panic("Sync and repair scripts only apply to two sources")
+		}
+		sources, err = createSources(f, *o.sources)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		primary, err = f.Create(
+			*o.masterDriver, *o.masterConnection, *o.masterConfig)
+		if err != nil {
+			panic(err)
+		}
+
+		secondary, err = f.Create(
+			*o.slaveDriver, *o.slaveConnection, *o.slaveConfig)
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	// Initialize primary data source
-	primary, err := f.Create(
-		*o.masterDriver, *o.masterConnection, *o.masterConfig)
+	// Stop in-flight queries on Ctrl-C or when the run exceeds its timeout
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if *o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *o.timeout)
+		defer cancel()
+	}
+
+	// Initialize output writer
+	w, err := output.NewWriter(*o.format, os.Stdout, *o.unsigned)
 	if err != nil {
 		panic(err)
 	}
+	summary := output.NewSummary()
 
-	// Initialize secondary data source
-	secondary, err := f.Create(
-		*o.slaveDriver, *o.slaveConnection, *o.slaveConfig)
+	// Initialize repair script generator if requested
+	var r *repair.Generator
+	if *o.repair != "" {
+		if *o.repairOut == "" {
+			panic("Repair output path must be given with -repair-out")
+		}
+		file, err := os.Create(*o.repairOut)
+		if err != nil {
+			panic(err)
+		}
+		defer file.Close()
+		r, err = repair.NewGenerator(*o.repair, *o.repairConfig, file, *o.unsigned)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	// Do magic here
+	opts := processing.Options{
+		Interval:             *o.initialInterval,
+		Branching:            *o.branchingFactor,
+		PrimaryConcurrency:   *o.masterConcurrency,
+		SecondaryConcurrency: *o.slaveConcurrency,
+		QueryTimeout:         *o.queryTimeout,
+		Fields:               fields,
+	}
+	if *o.state != "" {
+		opts.Checkpoint = &processing.Checkpoint{
+			Path:      *o.state,
+			Config:    o.stateConfig(),
+			Resume:    *o.resume,
+			Overwrite: *o.overwriteState,
+		}
+	} else if *o.resume || *o.overwriteState {
+		panic("State file path must be given with -state to resume or overwrite it")
+	}
+	if *o.baseline != "" {
+		opts.Incremental = &processing.Incremental{
+			Path:   *o.baseline,
+			Config: o.stateConfig(),
+		}
+	}
+	if *o.recheckRepeats < 0 {
+		panic("Recheck repeats must not be negative")
+	}
+	if *o.recheck {
+		opts.Recheck = &processing.Recheck{
+			Delay:   *o.settleDelay,
+			Repeats: *o.recheckRepeats,
+			Transient: func(d processing.Difference) error {
+				summary.AddTransient(d)
+				return nil
+			},
+		}
+	}
+	opts.OverCapacity = func(b processing.OverCapacity) error {
+		summary.AddOverCapacity(b)
+		return nil
+	}
+	handle := func(d processing.Difference) error {
+		summary.Add(d)
+		if r != nil {
+			err := r.Write(d)
+			if err != nil {
+				return err
+			}
+		}
+		return w.Write(d)
+	}
+	if o.command == "sync" {
+		err = processing.Sync(ctx, primary, secondary, opts, processing.SyncOptions{
+			BatchSize:    *o.batchSize,
+			MaxMutations: *o.maxMutations,
+			Delete:       *o.delete,
+			DryRun:       *o.dryRun,
+		}, handle, func(m processing.Mutation) error {
+			return printMutation(m, *o.dryRun, *o.unsigned)
+		})
+	} else if sources != nil {
+		err = processing.ProcessAll(ctx, sources, opts, handle)
+	} else {
+		err = processing.Process(ctx, primary, secondary, opts, handle)
+	}
 	if err != nil {
 		panic(err)
 	}
+	if r != nil {
+		err = r.Close()
+		if err != nil {
+			panic(err)
+		}
+	}
 
-	// Do magic here
-	err = processing.Process(primary, secondary, *o.initialInterval)
+	// Flush the output, ending it with the summary if requested
+	summary.Stop()
+	if !*o.summary {
+		summary = nil
+	}
+	err = w.Close(summary)
 	if err != nil {
 		panic(err)
 	}
 }
 
+// sourceConfig describes one of the data sources given with -sources
+type sourceConfig struct {
+	Name        string          `json:"name"`
+	Driver      string          `json:"driver"`
+	Conn        string          `json:"conn"`
+	Conf        json.RawMessage `json:"conf"`
+	Concurrency int             `json:"concurrency"`
+}
+
+// createSources instantiates the data sources of an N-way comparison from a JSON list of source configs
+func createSources(f datasource.DataSourceFactory, config string) ([]processing.Source, error) {
+	var configs []sourceConfig
+	err := json.Unmarshal([]byte(config), &configs)
+	if err != nil {
+		return nil, err
+	}
+	sources := make([]processing.Source, len(configs))
+	for i, c := range configs {
+		conf := "{}"
+		if len(c.Conf) != 0 {
+			conf = string(c.Conf)
+		}
+		sources[i].DataSource, err = f.Create(c.Driver, c.Conn, conf)
+		if err != nil {
+			return nil, fmt.Errorf("Source %s: %v", c.Name, err)
+		}
+		sources[i].Name = c.Name
+		sources[i].Concurrency = c.Concurrency
+		if sources[i].Concurrency == 0 {
+			sources[i].Concurrency = 4
+		}
+	}
+	return sources, nil
+}
+
+// printMutation reports a batch applied by sync on stderr, listing every ID when previewing a dry run
+func printMutation(m processing.Mutation, dryRun, unsigned bool) error {
+	if !dryRun {
+		_, err := fmt.Fprintf(os.Stderr, "%s %d records\n", m.Action, len(m.IDs))
+		return err
+	}
+	for _, id := range m.IDs {
+		_, err := fmt.Fprintf(os.Stderr, "dry-run %s %s\n", m.Action, datasource.FormatID(id, unsigned))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stateConfig describes the compared sources for the state file. Connection strings are hashed
+// since they may hold credentials. Keys are only compared between runs over the same kind of IDs.
+func (o *cliOpts) stateConfig() map[string]string {
+	hash := func(s string) string {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(s)))
+	}
+	c := map[string]string{
+		"mdriver": *o.masterDriver,
+		"mconn":   hash(*o.masterConnection),
+		"mconf":   *o.masterConfig,
+		"sdriver": *o.slaveDriver,
+		"sconn":   hash(*o.slaveConnection),
+		"sconf":   *o.slaveConfig,
+		"fields":  *o.fields,
+		"sources": hash(*o.sources),
+	}
+	// Left out for signed IDs so that earlier state files still match
+	if *o.unsigned {
+		c["unsigned"] = "true"
+	}
+	return c
+}
+
 type cliOpts struct {
-	initialInterval *int
+	// command is either diff or sync
+	command string
+
+	initialInterval *int64
+	branchingFactor *int
+	timeout         *time.Duration
+	queryTimeout    *time.Duration
+	format          *string
+	summary         *bool
+	fields          *string
+	repair          *string
+	repairConfig    *string
+	repairOut       *string
+	state           *string
+	resume          *bool
+	overwriteState  *bool
+	baseline        *string
+	sources         *string
+	recheck         *bool
+	settleDelay     *time.Duration
+	recheckRepeats  *int
+	unsigned        *bool
+
+	// Options for the sync command
+	batchSize    *int
+	maxMutations *int
+	delete       *bool
+	dryRun       *bool
 
 	// Options for primary source
-	masterDriver     *string
-	masterConnection *string
-	masterConfig     *string
+	masterDriver      *string
+	masterConnection  *string
+	masterConfig      *string
+	masterConcurrency *int
 
 	// Options for secondary source
-	slaveDriver     *string
-	slaveConnection *string
-	slaveConfig     *string
+	slaveDriver      *string
+	slaveConnection  *string
+	slaveConfig      *string
+	slaveConcurrency *int
 }
 
 func (o *cliOpts) parseFlags() {
+	// The first argument optionally selects the command
+	o.command = "diff"
+	args := os.Args[1:]
+	if len(args) != 0 && args[0] == "sync" {
+		o.command = "sync"
+		args = args[1:]
+	}
+
+	// Parse params for the sync command
+	if o.command == "sync" {
+		o.batchSize = flag.Int("batch-size", 500, "Number of records read and written per request")
+		o.maxMutations = flag.Int("max-mutations", 1000, "Maximum number of records written or deleted, nothing is applied beyond it")
+		o.delete = flag.Bool("delete", false, "Delete the records found only in the secondary source")
+		o.dryRun = flag.Bool("dry-run", false, "Print the mutations to stderr without applying them")
+	}
+
 	// Parse params for the primary data source
-	o.masterDriver = flag.String("mdriver", "", "Primary source driver [elasticsearch|mysql]")
+	o.masterDriver = flag.String("mdriver", "", "Primary source driver [mysql|postgres|sqlite|file|mongodb|es0|es7|es8|opensearch|sharded]")
 	o.masterConnection = flag.String("mconn", "", "Primary source connection string")
 	o.masterConfig = flag.String("mconf", "{}", "Primary source configuration string")
+	o.masterConcurrency = flag.Int("mconcurrency", 4, "Maximum number of concurrent queries to the primary source")
 
 	// Parse params for the secondary data source
-	o.slaveDriver = flag.String("sdriver", "", "Secondary source driver [elasticsearch|mysql]")
+	o.slaveDriver = flag.String("sdriver", "", "Secondary source driver [mysql|postgres|sqlite|file|mongodb|es0|es7|es8|opensearch|sharded]")
 	o.slaveConnection = flag.String("sconn", "", "Secondary source connection string")
 	o.slaveConfig = flag.String("sconf", "{}", "Secondary source configuration string")
+	o.slaveConcurrency = flag.Int("sconcurrency", 4, "Maximum number of concurrent queries to the secondary source")
 
 	// Parse universal params
-	o.initialInterval = flag.Int("interval", 1000, "Initial histogram interval size")
+	o.initialInterval = flag.Int64("interval", 1000, "Initial histogram interval size")
+	o.branchingFactor = flag.Int("branching", 10, "Number of sub-bins each unresolved bin is split into")
+	o.timeout = flag.Duration("timeout", 0, "Maximum duration of the whole run (0 for no limit)")
+	o.queryTimeout = flag.Duration("query-timeout", 0, "Maximum duration of a single query (0 for no limit)")
+	o.format = flag.String("format", "csv", "Output format [csv|jsonl|json]")
+	o.summary = flag.Bool("summary", false, "End the output with a summary of totals per side and elapsed time")
+	o.repair = flag.String("repair", "", "Write scripts repairing the secondary source [sql|es-bulk|mongodb|ids]")
+	o.repairConfig = flag.String("repair-conf", "{}", "Repair configuration string with template params and overrides")
+	o.repairOut = flag.String("repair-out", "", "Path of the file the repair scripts are written to")
+	o.state = flag.String("state", "", "Path of the state file progress is saved to")
+	o.resume = flag.Bool("resume", false, "Resume the comparison saved in the state file")
+	o.overwriteState = flag.Bool("overwrite-state", false, "Start over in place of an existing state file instead of refusing to")
+	o.baseline = flag.String("baseline", "", "Path of the baseline file; unchanged bins reuse the results of the previous run")
+	o.recheck = flag.Bool("recheck", false, "Re-fetch every difference after the settle delay and only report the ones found again")
+	o.settleDelay = flag.Duration("settle-delay", 30*time.Second, "Time waited before every recheck pass to let replication settle")
+	o.recheckRepeats = flag.Int("recheck-repeats", 0, "Number of recheck passes run after the first one")
+	o.sources = flag.String("sources", "", "JSON list of sources to compare all at once instead of a primary and secondary, as [{\"name\":\"...\",\"driver\":\"...\",\"conn\":\"...\",\"conf\":{},\"concurrency\":4}]")
+	o.unsigned = flag.Bool("unsigned", false, "Compare IDs as unsigned 64-bit integers, for mysql, postgres, file, es7, es8, opensearch and sharded sources")
+	o.fields = flag.String("fields", "", "JSON list of fields to compare record by record, as [{\"primary\":\"...\",\"secondary\":\"...\",\"type\":\"string|decimal|bool|date\"}]")
 
-	flag.Parse()
+	flag.CommandLine.Parse(args)
 }
@@ -0,0 +1,73 @@
+package output
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/arturom/datadiff/processing"
+)
+
+var csvHeader = []string{"id", "type", "missing_from", "duplicated_in", "occurrences", "fields", "sources", "range_start", "range_end"}
+
+// csvWriter writes differences as CSV rows preceded by a header.
+// The summary does not fit the columns, so it is written to a separate writer as JSON.
+type csvWriter struct {
+	w             *csv.Writer
+	summary       io.Writer
+	unsigned      bool
+	headerWritten bool
+}
+
+func newCSVWriter(w, summary io.Writer, unsigned bool) *csvWriter {
+	return &csvWriter{w: csv.NewWriter(w), summary: summary, unsigned: unsigned}
+}
+
+func (c *csvWriter) Write(d processing.Difference) error {
+	err := c.writeHeader()
+	if err != nil {
+		return err
+	}
+	r := newRecord(d, c.unsigned)
+	occurrences := ""
+	if r.Occurrences != 0 {
+		occurrences = strconv.FormatInt(r.Occurrences, 10)
+	}
+	return c.w.Write([]string{
+		r.ID.String(),
+		r.Type,
+		r.MissingFrom,
+		r.DuplicatedIn,
+		occurrences,
+		strings.Join(r.Fields, ";"),
+		strings.Join(r.Sources, ";"),
+		r.RangeStart.String(),
+		r.RangeEnd.String(),
+	})
+}
+
+func (c *csvWriter) Close(s *Summary) error {
+	err := c.writeHeader()
+	if err != nil {
+		return err
+	}
+	c.w.Flush()
+	err = c.w.Error()
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		return json.NewEncoder(c.summary).Encode(s)
+	}
+	return nil
+}
+
+func (c *csvWriter) writeHeader() error {
+	if c.headerWritten {
+		return nil
+	}
+	c.headerWritten = true
+	return c.w.Write(csvHeader)
+}
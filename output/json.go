@@ -0,0 +1,85 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+
+	"github.com/arturom/datadiff/processing"
+)
+
+// jsonLinesWriter writes one JSON object per difference, followed by a summary line
+type jsonLinesWriter struct {
+	buf      *bufio.Writer
+	enc      *json.Encoder
+	unsigned bool
+}
+
+func newJSONLinesWriter(w io.Writer, unsigned bool) *jsonLinesWriter {
+	buf := bufio.NewWriter(w)
+	return &jsonLinesWriter{
+		buf:      buf,
+		enc:      json.NewEncoder(buf),
+		unsigned: unsigned,
+	}
+}
+
+func (j *jsonLinesWriter) Write(d processing.Difference) error {
+	return j.enc.Encode(newRecord(d, j.unsigned))
+}
+
+func (j *jsonLinesWriter) Close(s *Summary) error {
+	if s != nil {
+		err := j.enc.Encode(struct {
+			Summary *Summary `json:"summary"`
+		}{s})
+		if err != nil {
+			return err
+		}
+	}
+	return j.buf.Flush()
+}
+
+// jsonWriter writes a single JSON document holding all the differences and the summary.
+// Differences are streamed as they arrive rather than held in memory.
+type jsonWriter struct {
+	buf      *bufio.Writer
+	count    int
+	unsigned bool
+}
+
+func newJSONWriter(w io.Writer, unsigned bool) *jsonWriter {
+	return &jsonWriter{buf: bufio.NewWriter(w), unsigned: unsigned}
+}
+
+func (j *jsonWriter) Write(d processing.Difference) error {
+	sep := ","
+	if j.count == 0 {
+		sep = `{"differences":[`
+	}
+	j.count++
+	b, err := json.Marshal(newRecord(d, j.unsigned))
+	if err != nil {
+		return err
+	}
+	j.buf.WriteString(sep)
+	_, err = j.buf.Write(b)
+	return err
+}
+
+func (j *jsonWriter) Close(s *Summary) error {
+	if j.count == 0 {
+		j.buf.WriteString(`{"differences":[`)
+	}
+	j.buf.WriteString("]")
+	if s != nil {
+		b, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		j.buf.WriteString(`,"summary":`)
+		j.buf.Write(b)
+	}
+	j.buf.WriteString("}\n")
+	return j.buf.Flush()
+}
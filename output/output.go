@@ -0,0 +1,134 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/arturom/datadiff/datasource"
+	"github.com/arturom/datadiff/processing"
+)
+
+// Writer writes differences in a specific format
+type Writer interface {
+	// Write writes a single difference
+	Write(d processing.Difference) error
+	// Close flushes the output, ending it with the summary when one is given
+	Close(s *Summary) error
+}
+
+// NewWriter instantiates a writer based on the format given. Unsigned writes the IDs of the keys compared.
+func NewWriter(format string, w io.Writer, unsigned bool) (Writer, error) {
+	// The summary of CSV output goes to stderr
+	if format == "csv" {
+		return newCSVWriter(w, os.Stderr, unsigned), nil
+	}
+
+	if format == "jsonl" {
+		return newJSONLinesWriter(w, unsigned), nil
+	}
+
+	if format == "json" {
+		return newJSONWriter(w, unsigned), nil
+	}
+
+	return nil, fmt.Errorf("No output matching format: %s", format)
+}
+
+// Summary describes the totals of a run
+type Summary struct {
+	MissingFromPrimary    int `json:"missing_from_primary"`
+	MissingFromSecondary  int `json:"missing_from_secondary"`
+	Modified              int `json:"modified"`
+	DuplicatedInPrimary   int `json:"duplicated_in_primary"`
+	DuplicatedInSecondary int `json:"duplicated_in_secondary"`
+	// Missing and Duplicated count the differences found across more than two sources
+	Missing    int `json:"missing,omitempty"`
+	Duplicated int `json:"duplicated,omitempty"`
+	// Transient counts the differences that disappeared when rechecked, which are not written
+	Transient int `json:"transient,omitempty"`
+	// OverCapacityBins counts the top-level bins of every source holding more records than IDs
+	OverCapacityBins int     `json:"over_capacity_bins,omitempty"`
+	ElapsedSeconds   float64 `json:"elapsed_seconds"`
+	start            time.Time
+}
+
+// NewSummary starts timing a run
+func NewSummary() *Summary {
+	return &Summary{start: time.Now()}
+}
+
+// Add counts a difference towards the totals
+func (s *Summary) Add(d processing.Difference) {
+	if len(d.Sources) != 0 && d.Type != processing.Modified {
+		if d.Type == processing.Duplicate {
+			s.Duplicated++
+		} else {
+			s.Missing++
+		}
+	} else if d.Type == processing.Modified {
+		s.Modified++
+	} else if d.Type == processing.Duplicate {
+		if d.DuplicatedIn == processing.Primary {
+			s.DuplicatedInPrimary++
+		} else {
+			s.DuplicatedInSecondary++
+		}
+	} else if d.MissingFrom == processing.Primary {
+		s.MissingFromPrimary++
+	} else {
+		s.MissingFromSecondary++
+	}
+}
+
+// AddTransient counts a difference that disappeared when rechecked
+func (s *Summary) AddTransient(d processing.Difference) {
+	s.Transient++
+}
+
+// AddOverCapacity counts a bin certain to hold duplicate IDs
+func (s *Summary) AddOverCapacity(b processing.OverCapacity) {
+	s.OverCapacityBins++
+}
+
+// Stop records the time elapsed since the summary was created
+func (s *Summary) Stop() {
+	s.ElapsedSeconds = time.Since(s.start).Seconds()
+}
+
+// record is the serialized form of a difference. IDs are numbers that may not fit an int64 when unsigned.
+type record struct {
+	ID           json.Number `json:"id"`
+	Type         string      `json:"type"`
+	MissingFrom  string      `json:"missing_from,omitempty"`
+	DuplicatedIn string      `json:"duplicated_in,omitempty"`
+	Occurrences  int64       `json:"occurrences,omitempty"`
+	Fields       []string    `json:"fields,omitempty"`
+	Sources      []string    `json:"sources,omitempty"`
+	RangeStart   json.Number `json:"range_start"`
+	RangeEnd     json.Number `json:"range_end"`
+}
+
+func newRecord(d processing.Difference, unsigned bool) record {
+	r := record{
+		ID:         json.Number(datasource.FormatID(d.ID, unsigned)),
+		Type:       d.Type.String(),
+		Fields:     d.Fields,
+		Sources:    d.Sources,
+		RangeStart: json.Number(datasource.FormatID(d.RangeStart, unsigned)),
+		RangeEnd:   json.Number(datasource.FormatID(d.RangeEnd, unsigned)),
+	}
+	// Differences across more than two sources name the sources instead of a side
+	if d.Type == processing.Missing && len(d.Sources) == 0 {
+		r.MissingFrom = d.MissingFrom.String()
+	}
+	if d.Type == processing.Duplicate {
+		if len(d.Sources) == 0 {
+			r.DuplicatedIn = d.DuplicatedIn.String()
+		}
+		r.Occurrences = d.Occurrences
+	}
+	return r
+}
@@ -0,0 +1,180 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arturom/datadiff/processing"
+)
+
+// differences holds differences between two sources, with field names needing quotes in CSV
+var differences = []processing.Difference{
+	{ID: -3, Type: processing.Missing, MissingFrom: processing.Primary, RangeStart: -10, RangeEnd: 0},
+	{ID: 4, Type: processing.Modified, Fields: []string{"name", `"quoted", with comma`}, Sources: []string{}, RangeStart: 0, RangeEnd: 10},
+	{ID: 5, Type: processing.Duplicate, DuplicatedIn: processing.Secondary, Occurrences: 2, RangeStart: 0, RangeEnd: 10},
+}
+
+// summary counts the differences
+func summary() *Summary {
+	s := &Summary{}
+	for _, d := range differences {
+		s.Add(d)
+	}
+	return s
+}
+
+// write writes the differences with the writer and closes it with the summary given
+func write(t *testing.T, w Writer, diffs []processing.Difference, s *Summary) {
+	for _, d := range diffs {
+		err := w.Write(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := w.Close(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+const summaryJSON = `{"missing_from_primary":1,"missing_from_secondary":0,"modified":1,"duplicated_in_primary":0,"duplicated_in_secondary":1,"elapsed_seconds":0}`
+
+func TestCSVWriter(t *testing.T) {
+	var out, stderr bytes.Buffer
+	write(t, newCSVWriter(&out, &stderr, false), differences, summary())
+	want := "id,type,missing_from,duplicated_in,occurrences,fields,sources,range_start,range_end\n" +
+		"-3,missing,primary,,,,,-10,0\n" +
+		`4,modified,,,,"name;""quoted"", with comma",,0,10` + "\n" +
+		"5,duplicate,,secondary,2,,,0,10\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The summary does not fit the columns, so it is written apart
+	if got := stderr.String(); got != summaryJSON+"\n" {
+		t.Errorf("got summary %q, want %q", got, summaryJSON+"\n")
+	}
+}
+
+func TestCSVWriterWithoutDifferences(t *testing.T) {
+	var out, stderr bytes.Buffer
+	write(t, newCSVWriter(&out, &stderr, false), nil, nil)
+	if got, want := out.String(), strings.Join(csvHeader, ",")+"\n"; got != want {
+		t.Errorf("got %q, want only the header %q", got, want)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("got summary %q, want none", stderr.String())
+	}
+}
+
+func TestJSONLinesWriter(t *testing.T) {
+	var out bytes.Buffer
+	write(t, newJSONLinesWriter(&out, false), differences, summary())
+	want := `{"id":-3,"type":"missing","missing_from":"primary","range_start":-10,"range_end":0}` + "\n" +
+		`{"id":4,"type":"modified","fields":["name","\"quoted\", with comma"],"range_start":0,"range_end":10}` + "\n" +
+		`{"id":5,"type":"duplicate","duplicated_in":"secondary","occurrences":2,"range_start":0,"range_end":10}` + "\n" +
+		`{"summary":` + summaryJSON + "}\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	out.Reset()
+	write(t, newJSONLinesWriter(&out, false), nil, nil)
+	if out.Len() != 0 {
+		t.Errorf("got %q, want no output", out.String())
+	}
+}
+
+func TestJSONWriter(t *testing.T) {
+	var out bytes.Buffer
+	write(t, newJSONWriter(&out, false), differences, summary())
+	want := `{"differences":[` +
+		`{"id":-3,"type":"missing","missing_from":"primary","range_start":-10,"range_end":0},` +
+		`{"id":4,"type":"modified","fields":["name","\"quoted\", with comma"],"range_start":0,"range_end":10},` +
+		`{"id":5,"type":"duplicate","duplicated_in":"secondary","occurrences":2,"range_start":0,"range_end":10}` +
+		`],"summary":` + summaryJSON + "}\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if !json.Valid(out.Bytes()) {
+		t.Errorf("got invalid JSON %q", out.String())
+	}
+
+	// Without differences or summary the document is still valid
+	out.Reset()
+	write(t, newJSONWriter(&out, false), nil, nil)
+	if got, want := out.String(), `{"differences":[]}`+"\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWritersFormatUnsignedIDs(t *testing.T) {
+	// Keys are written as the unsigned IDs they map, the key 1 being 2^63 + 1
+	d := []processing.Difference{
+		{ID: 1, Type: processing.Missing, MissingFrom: processing.Secondary, RangeStart: -9223372036854775808, RangeEnd: 9223372036854775807},
+	}
+
+	var out, stderr bytes.Buffer
+	write(t, newCSVWriter(&out, &stderr, true), d, nil)
+	want := strings.Join(csvHeader, ",") + "\n" + "9223372036854775809,missing,secondary,,,,,0,18446744073709551615\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	out.Reset()
+	write(t, newJSONLinesWriter(&out, true), d, nil)
+	want = `{"id":9223372036854775809,"type":"missing","missing_from":"secondary","range_start":0,"range_end":18446744073709551615}` + "\n"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSummaryAdd(t *testing.T) {
+	s := &Summary{}
+	for _, d := range []processing.Difference{
+		{Type: processing.Missing, MissingFrom: processing.Primary},
+		{Type: processing.Missing, MissingFrom: processing.Secondary},
+		{Type: processing.Missing, MissingFrom: processing.Secondary},
+		{Type: processing.Modified},
+		{Type: processing.Duplicate, DuplicatedIn: processing.Primary},
+		{Type: processing.Duplicate, DuplicatedIn: processing.Secondary},
+		// Differences across more than two sources name the sources instead of a side
+		{Type: processing.Missing, Sources: []string{"a", "b"}},
+		{Type: processing.Duplicate, Sources: []string{"c"}},
+		{Type: processing.Modified, Sources: []string{"a", "b", "c"}},
+	} {
+		s.Add(d)
+	}
+	s.AddTransient(processing.Difference{})
+	s.AddOverCapacity(processing.OverCapacity{})
+	want := Summary{
+		MissingFromPrimary:    1,
+		MissingFromSecondary:  2,
+		Modified:              2,
+		DuplicatedInPrimary:   1,
+		DuplicatedInSecondary: 1,
+		Missing:               1,
+		Duplicated:            1,
+		Transient:             1,
+		OverCapacityBins:      1,
+	}
+	if !reflect.DeepEqual(*s, want) {
+		t.Errorf("got %+v, want %+v", *s, want)
+	}
+}
+
+func TestNewWriter(t *testing.T) {
+	for _, format := range []string{"csv", "jsonl", "json"} {
+		_, err := NewWriter(format, &bytes.Buffer{}, false)
+		if err != nil {
+			t.Errorf("%s: got error %v", format, err)
+		}
+	}
+	_, err := NewWriter("xml", &bytes.Buffer{}, false)
+	if err == nil {
+		t.Errorf("got no error for an unknown format")
+	}
+}
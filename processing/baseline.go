@@ -0,0 +1,84 @@
+package processing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	"github.com/arturom/datadiff/histogram"
+)
+
+// Incremental saves the histogram pyramid and differences of every run to a baseline file. The next run
+// reuses the results of the bins whose counts and checksums have not changed on either side since then,
+// rather than drilling into them again.
+type Incremental struct {
+	// Path is the baseline file. A missing file starts a full comparison.
+	Path string
+	// Config describes the sources being compared. A baseline recorded with another config is refused.
+	Config map[string]string
+}
+
+type baseline struct {
+	Config      map[string]string  `json:"config"`
+	Interval    int64              `json:"interval"`
+	Branching   int                `json:"branching"`
+	Pyramid     *histogram.Pyramid `json:"pyramid"`
+	Differences []Difference       `json:"differences"`
+}
+
+// loadBaseline reads the baseline of the previous run, returning nil if there is none
+func loadBaseline(i *Incremental, interval int64, branching int) (*baseline, error) {
+	f, err := os.Open(i.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &baseline{}
+	err = json.NewDecoder(f).Decode(b)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read baseline file: %v", err)
+	}
+	if !reflect.DeepEqual(b.Config, i.Config) || b.Interval != interval || b.Branching != branching {
+		return nil, fmt.Errorf("Baseline file %s was recorded for a different comparison", i.Path)
+	}
+	return b, nil
+}
+
+// saveBaseline replaces the baseline file, writing to a temporary file first so that a crash never leaves it half written
+func saveBaseline(i *Incremental, b *baseline) error {
+	f, err := os.CreateTemp(filepath.Dir(i.Path), filepath.Base(i.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	err = json.NewEncoder(f).Encode(b)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), i.Path)
+}
+
+// differencesInRange returns the differences of the baseline found in [gte, lt). The differences must be sorted by ID.
+func (b *baseline) differencesInRange(gte, lt int64) []Difference {
+	from := sort.Search(len(b.Differences), func(i int) bool {
+		return b.Differences[i].ID >= gte
+	})
+	to := sort.Search(len(b.Differences), func(i int) bool {
+		return b.Differences[i].ID >= lt
+	})
+	return b.Differences[from:to]
+}
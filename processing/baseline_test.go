@@ -0,0 +1,123 @@
+package processing
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// sqliteExec runs a statement against a SQLite file
+func sqliteExec(t *testing.T, path, statement string) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(statement)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIncrementalReusesUnchangedBins(t *testing.T) {
+	primary, secondary := checkpointTables(t)
+	o := Options{Interval: 1000, Branching: 10}
+	full, _, err := runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first run has no baseline, so it drills into every unresolved bin
+	o.Incremental = &Incremental{Path: filepath.Join(t.TempDir(), "baseline.json"), Config: map[string]string{"primary": primary}}
+	got, p, err := runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, full) {
+		t.Errorf("got %v, want %v as found by a full run", got, full)
+	}
+	if len(p.ranges) == 0 {
+		t.Errorf("drilled into no range, want the unresolved bins drilled into")
+	}
+
+	// Nothing changed since, so the differences of the baseline are reported without drilling into any bin
+	got, p, err = runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, full) {
+		t.Errorf("got %v, want %v as found by a full run", got, full)
+	}
+	if len(p.ranges) != 0 {
+		t.Errorf("drilled into %v, want every bin reused from the baseline", p.ranges)
+	}
+}
+
+func TestIncrementalDrillsIntoChangedBins(t *testing.T) {
+	primary, secondary := checkpointTables(t)
+	o := Options{
+		Interval:    1000,
+		Branching:   10,
+		Incremental: &Incremental{Path: filepath.Join(t.TempDir(), "baseline.json"), Config: map[string]string{"primary": primary}},
+	}
+	_, _, err := runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 700 is replicated and 6000 deleted from the secondary source, changing the counts of the bins 0 and 6000
+	sqliteExec(t, secondary, `INSERT INTO "records" VALUES (700, 'record 700')`)
+	sqliteExec(t, secondary, `DELETE FROM "records" WHERE "id" = 6000`)
+	got, p, err := runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _, err := runProcess(t, primary, secondary, Options{Interval: 1000, Branching: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, full) {
+		t.Errorf("got %v, want %v as found by a full run", got, full)
+	}
+	for _, r := range p.ranges {
+		if !(r[0] >= 0 && r[1] <= 1000) && !(r[0] >= 6000 && r[1] <= 7000) {
+			t.Errorf("drilled into %v, want only the bins 0 and 6000 drilled into", r)
+		}
+	}
+
+	// Within the bin 0, only the sub-bin of 700 changed while the one of 55 is reused
+	for _, r := range p.ranges {
+		if r[0] >= 0 && r[1] <= 100 {
+			t.Errorf("drilled into %v, want the sub-bin of 55 reused from the baseline", r)
+		}
+	}
+}
+
+func TestIncrementalRefusesAnotherComparison(t *testing.T) {
+	primary, secondary := checkpointTables(t)
+	path := filepath.Join(t.TempDir(), "baseline.json")
+	o := Options{Interval: 1000, Branching: 10, Incremental: &Incremental{Path: path, Config: map[string]string{"primary": primary}}}
+	_, _, err := runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config map[string]string
+		o      Options
+	}{
+		{"config", map[string]string{"primary": secondary}, Options{Interval: 1000, Branching: 10}},
+		{"interval", map[string]string{"primary": primary}, Options{Interval: 500, Branching: 10}},
+		{"branching", map[string]string{"primary": primary}, Options{Interval: 1000, Branching: 4}},
+	}
+	for _, tt := range tests {
+		tt.o.Incremental = &Incremental{Path: path, Config: tt.config}
+		_, _, err = runProcess(t, primary, secondary, tt.o)
+		if err == nil || !strings.Contains(err.Error(), "different comparison") {
+			t.Errorf("%s: got error %v, want the baseline refused", tt.name, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package processing
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+)
+
+// Checkpoint persists the progress of a comparison to a state file so that an interrupted run can be resumed.
+// The state file holds a header describing the comparison, followed by one line per top-level bin
+// drilled into along with the differences found in it.
+type Checkpoint struct {
+	// Path is the state file
+	Path string
+	// Config describes the sources being compared. Resuming from a state file recorded with another config is refused.
+	Config map[string]string
+	// Resume reuses the bins resolved by a previous run instead of starting a new state file
+	Resume bool
+	// Overwrite starts a new state file in place of an existing one, which is refused otherwise
+	// so that the progress of an interrupted run is not lost by forgetting to resume it
+	Overwrite bool
+}
+
+type stateHeader struct {
+	Config    map[string]string `json:"config"`
+	Interval  int64             `json:"interval"`
+	Branching int               `json:"branching"`
+}
+
+type stateBin struct {
+	Key         int64        `json:"bin"`
+	Differences []Difference `json:"differences"`
+}
+
+// journal appends the top-level bins as they are resolved to the state file
+type journal struct {
+	mu       sync.Mutex
+	file     *os.File
+	enc      *json.Encoder
+	resolved map[int64][]Difference
+}
+
+func openJournal(c *Checkpoint, interval int64, branching int) (*journal, error) {
+	header := stateHeader{
+		Config:    c.Config,
+		Interval:  interval,
+		Branching: branching,
+	}
+	j := &journal{resolved: make(map[int64][]Difference)}
+
+	var err error
+	if c.Resume && c.Overwrite {
+		return nil, fmt.Errorf("State file %s cannot be both resumed and overwritten", c.Path)
+	}
+	if c.Resume {
+		j.file, err = os.OpenFile(c.Path, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		err = j.load(header)
+	} else {
+		flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+		if c.Overwrite {
+			flags = os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		}
+		j.file, err = os.OpenFile(c.Path, flags, 0666)
+		if errors.Is(err, os.ErrExist) {
+			return nil, fmt.Errorf("State file %s already exists, resume or overwrite it", c.Path)
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = json.NewEncoder(j.file).Encode(header)
+	}
+	if err != nil {
+		j.file.Close()
+		return nil, err
+	}
+
+	j.enc = json.NewEncoder(j.file)
+	return j, nil
+}
+
+// load reads the bins resolved by a previous run, dropping a last line left incomplete by a crash
+func (j *journal) load(expected stateHeader) error {
+	dec := json.NewDecoder(j.file)
+	header := stateHeader{}
+	err := dec.Decode(&header)
+	if err != nil {
+		return fmt.Errorf("Failed to read state file header: %v", err)
+	}
+	if !reflect.DeepEqual(header, expected) {
+		return fmt.Errorf("State file %s was recorded for a different comparison", j.file.Name())
+	}
+
+	offset := dec.InputOffset()
+	for {
+		bin := stateBin{}
+		err = dec.Decode(&bin)
+		if err != nil {
+			break
+		}
+		j.resolved[bin.Key] = bin.Differences
+		offset = dec.InputOffset()
+	}
+	if !errors.Is(err, io.EOF) {
+		err = j.file.Truncate(offset)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The decoder reads ahead, so the end of the last complete line is where appending resumes
+	_, err = j.file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.WriteString("\n")
+	return err
+}
+
+// lookup returns the differences of a bin resolved by a previous run
+func (j *journal) lookup(key int64) ([]Difference, bool) {
+	d, ok := j.resolved[key]
+	return d, ok
+}
+
+// record appends a resolved bin to the state file and syncs it to disk
+func (j *journal) record(key int64, diffs []Difference) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	err := j.enc.Encode(stateBin{Key: key, Differences: diffs})
+	if err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
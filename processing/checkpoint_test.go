@@ -0,0 +1,170 @@
+package processing
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/arturom/datadiff/datasource"
+	"github.com/arturom/datadiff/histogram"
+)
+
+// recordingSource records the ranges drilled into in the source it wraps
+type recordingSource struct {
+	datasource.DataSource
+
+	mu     sync.Mutex
+	ranges [][2]int64
+}
+
+func (s *recordingSource) record(gte, lt int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ranges = append(s.ranges, [2]int64{gte, lt})
+}
+
+func (s *recordingSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	s.record(gte, lt)
+	return s.DataSource.FetchHistogramRange(ctx, gte, lt, interval)
+}
+
+func (s *recordingSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	s.record(gte, lt)
+	return s.DataSource.FetchIDRange(ctx, gte, lt)
+}
+
+// drilledInto returns the ranges drilled into that overlap [gte, lt)
+func (s *recordingSource) drilledInto(gte, lt int64) [][2]int64 {
+	var overlapping [][2]int64
+	for _, r := range s.ranges {
+		if r[0] < lt && r[1] > gte {
+			overlapping = append(overlapping, r)
+		}
+	}
+	return overlapping
+}
+
+// runProcess compares two SQLite files, recording the ranges drilled into in the primary one
+func runProcess(t *testing.T, primary, secondary string, o Options) ([]Difference, *recordingSource, error) {
+	p := &recordingSource{DataSource: openSqlite(t, primary, sqliteConfig)}
+	var diffs []Difference
+	err := Process(context.Background(), p, openSqlite(t, secondary, sqliteConfig), o, func(d Difference) error {
+		diffs = append(diffs, d)
+		return nil
+	})
+	return diffs, p, err
+}
+
+// checkpointTables returns two SQLite files differing in the bins 0, 4000, 8000 and 9000 of 1000 IDs
+func checkpointTables(t *testing.T) (string, string) {
+	primary := sqliteTable(t, "primary", idRange(0, 10000, 700, 4321, 8888), nil)
+	secondary := sqliteTable(t, "secondary", append(idRange(0, 10000, 55), 9001), nil)
+	return primary, secondary
+}
+
+func TestCheckpointResumesInterruptedRun(t *testing.T) {
+	primary, secondary := checkpointTables(t)
+	o := Options{Interval: 1000, Branching: 10}
+	full, _, err := runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	o.Checkpoint = &Checkpoint{Path: path, Config: map[string]string{"primary": primary}}
+	_, _, err = runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Interrupt the run after two bins, in the middle of writing the third
+	state, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(state), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("got %d lines in the state file, want a header, 4 bins and a final newline", len(lines))
+	}
+	var completed []int64
+	for _, line := range lines[1:3] {
+		bin := stateBin{}
+		err = json.Unmarshal([]byte(line), &bin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		completed = append(completed, bin.Key)
+	}
+	truncated := strings.Join(lines[:3], "\n") + "\n" + lines[3][:len(lines[3])/2]
+	err = os.WriteFile(path, []byte(truncated), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o.Checkpoint.Resume = true
+	resumed, p, err := runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(resumed, full) {
+		t.Errorf("got %v, want %v as found by a full run", resumed, full)
+	}
+	for _, key := range completed {
+		if drilled := p.drilledInto(key, key+1000); len(drilled) != 0 {
+			t.Errorf("drilled into %v of bin %d, want it skipped since it was completed", drilled, key)
+		}
+	}
+
+	// The incomplete line is replaced by the bins compared again, so the state file is whole again
+	state, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines = strings.Split(strings.TrimSuffix(string(state), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Errorf("got %d lines in the resumed state file, want a header and 4 bins", len(lines))
+	}
+	for _, line := range lines[1:] {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("got incomplete line %q in the resumed state file", line)
+		}
+	}
+}
+
+func TestCheckpointRefusesAnotherComparison(t *testing.T) {
+	primary, secondary := checkpointTables(t)
+	path := filepath.Join(t.TempDir(), "state.jsonl")
+	o := Options{Interval: 1000, Branching: 10, Checkpoint: &Checkpoint{Path: path, Config: map[string]string{"primary": primary}}}
+	_, _, err := runProcess(t, primary, secondary, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An existing state file is neither resumed nor overwritten unless asked to
+	_, _, err = runProcess(t, primary, secondary, o)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("got error %v, want the existing state file refused", err)
+	}
+
+	tests := []struct {
+		name   string
+		config map[string]string
+		o      Options
+	}{
+		{"config", map[string]string{"primary": secondary}, Options{Interval: 1000, Branching: 10}},
+		{"interval", map[string]string{"primary": primary}, Options{Interval: 500, Branching: 10}},
+		{"branching", map[string]string{"primary": primary}, Options{Interval: 1000, Branching: 4}},
+	}
+	for _, tt := range tests {
+		tt.o.Checkpoint = &Checkpoint{Path: path, Config: tt.config, Resume: true}
+		_, _, err = runProcess(t, primary, secondary, tt.o)
+		if err == nil || !strings.Contains(err.Error(), "different comparison") {
+			t.Errorf("%s: got error %v, want the state file refused", tt.name, err)
+		}
+	}
+}
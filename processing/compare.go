@@ -0,0 +1,156 @@
+package processing
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/arturom/datadiff/datasource"
+)
+
+// FieldType tells how the values of a field are normalized before they are compared
+type FieldType string
+
+const (
+	// StringField values are compared by their text representation
+	StringField FieldType = "string"
+	// DecimalField values are compared as exact numbers, so 1.50 matches 1.5
+	DecimalField FieldType = "decimal"
+	// BoolField values are compared as booleans, so 1 matches true
+	BoolField FieldType = "bool"
+	// DateField values are compared as instants in UTC. Numbers are read as epoch milliseconds.
+	DateField FieldType = "date"
+)
+
+// FieldMapping pairs a field of the primary source with the corresponding field of the secondary source
+type FieldMapping struct {
+	// Primary is the column name or document path in the primary source
+	Primary string `json:"primary"`
+	// Secondary is the column name or document path in the secondary source, defaulting to Primary
+	Secondary string `json:"secondary"`
+	// Type is how values are normalized before they are compared, defaulting to StringField
+	Type FieldType `json:"type"`
+}
+
+// dateLayouts are tried in order when parsing dates from text. Dates without a zone are read as UTC.
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// compareRecords returns the primary names of the mapped fields whose values differ between the two records
+func compareRecords(fields []FieldMapping, primary, secondary datasource.Record) []string {
+	var diffs []string
+	for _, f := range fields {
+		if !valuesEqual(primary[f.Primary], secondary[f.secondary()], f.Type) {
+			diffs = append(diffs, f.Primary)
+		}
+	}
+	return diffs
+}
+
+func (f FieldMapping) secondary() string {
+	if f.Secondary == "" {
+		return f.Primary
+	}
+	return f.Secondary
+}
+
+// valuesEqual compares two values after normalizing them to the field type.
+// Values that cannot be normalized are compared by their text representation instead.
+func valuesEqual(a, b interface{}, t FieldType) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	na, errA := normalize(a, t)
+	nb, errB := normalize(b, t)
+	if errA != nil || errB != nil {
+		return toString(a) == toString(b)
+	}
+	return na == nb
+}
+
+func normalize(v interface{}, t FieldType) (string, error) {
+	switch t {
+	case DecimalField:
+		return normalizeDecimal(v)
+	case BoolField:
+		return normalizeBool(v)
+	case DateField:
+		return normalizeDate(v)
+	}
+	return toString(v), nil
+}
+
+func normalizeDecimal(v interface{}) (string, error) {
+	r, ok := new(big.Rat).SetString(strings.TrimSpace(toString(v)))
+	if !ok {
+		return "", fmt.Errorf("Invalid decimal value: %v", v)
+	}
+	return r.RatString(), nil
+}
+
+func normalizeBool(v interface{}) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(toString(v))) {
+	case "1", "true", "t", "yes", "y", "on":
+		return "true", nil
+	case "0", "false", "f", "no", "n", "off":
+		return "false", nil
+	}
+	return "", fmt.Errorf("Invalid boolean value: %v", v)
+}
+
+func normalizeDate(v interface{}) (string, error) {
+	t, err := toTime(v)
+	if err != nil {
+		return "", err
+	}
+	return t.UTC().Format(time.RFC3339Nano), nil
+}
+
+func toTime(v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case time.Time:
+		return v, nil
+	case interface{ Time() time.Time }:
+		// BSON dates and timestamps
+		return v.Time(), nil
+	}
+
+	s := strings.TrimSpace(toString(v))
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	for _, layout := range dateLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("Invalid date value: %v", v)
+}
+
+// toString renders a value as returned by any of the data sources as text
+func toString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case json.Number:
+		return v.String()
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,74 @@
+package processing
+
+// Side identifies one of the two data sources being compared
+type Side int
+
+const (
+	// Primary is the data source treated as the source of truth
+	Primary Side = iota
+	// Secondary is the data source expected to mirror the primary
+	Secondary
+)
+
+func (s Side) String() string {
+	if s == Primary {
+		return "primary"
+	}
+	return "secondary"
+}
+
+// DifferenceType tells whether a record is missing from one side or holds different content on each
+type DifferenceType int
+
+const (
+	// Missing records exist in only one of the data sources
+	Missing DifferenceType = iota
+	// Modified records exist in both data sources but their checksums or compared fields differ
+	Modified
+	// Duplicate IDs occur in more than one record of a data source
+	Duplicate
+)
+
+func (t DifferenceType) String() string {
+	if t == Modified {
+		return "modified"
+	}
+	if t == Duplicate {
+		return "duplicate"
+	}
+	return "missing"
+}
+
+// Difference describes an ID that exists in only one of the data sources, whose content differs,
+// or that is duplicated within a data source
+type Difference struct {
+	ID   int64
+	Type DifferenceType
+	// MissingFrom is the data source that does not contain the ID. It is only meaningful for missing records.
+	MissingFrom Side
+	// DuplicatedIn is the data source holding the ID more than once, and Occurrences the number of
+	// records holding it. They are only meaningful for duplicate IDs.
+	DuplicatedIn Side
+	Occurrences  int64
+	// Fields lists the compared fields that differ. It is only set for modified records found by field comparison.
+	Fields []string
+	// Sources lists the names of the data sources holding the ID, or the source duplicating it.
+	// It is only set by ProcessAll for more than two sources, which leaves MissingFrom and DuplicatedIn unset.
+	Sources []string
+	// RangeStart and RangeEnd delimit the range [RangeStart, RangeEnd) whose IDs were compared
+	RangeStart int64
+	RangeEnd   int64
+}
+
+// OverCapacity describes a top-level bin counting more records than it has IDs in a source,
+// which is certain to hold duplicate IDs even before they are narrowed down
+type OverCapacity struct {
+	// Source names the source, primary or secondary when comparing two sources
+	Source     string
+	RangeStart int64
+	RangeEnd   int64
+	Count      int64
+}
+
+// Handler receives the differences found by Process. Returning an error stops the comparison.
+type Handler func(d Difference) error
@@ -0,0 +1,120 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/arturom/datadiff/datasource"
+	"github.com/arturom/datadiff/histogram"
+)
+
+// limitedSource wraps a data source so that no more than a fixed number of queries run at once.
+// Each query is also bounded by the timeout when one is set.
+type limitedSource struct {
+	source  datasource.DataSource
+	slots   chan struct{}
+	timeout time.Duration
+}
+
+func newLimitedSource(source datasource.DataSource, concurrency int, timeout time.Duration) limitedSource {
+	return limitedSource{
+		source:  source,
+		slots:   make(chan struct{}, max(concurrency, 1)),
+		timeout: timeout,
+	}
+}
+
+// acquire waits for a free slot and returns the context for a single query along with its release func
+func (s limitedSource) acquire(ctx context.Context) (context.Context, func(), error) {
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	cancel := func() {}
+	if s.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+	}
+	return ctx, func() {
+		cancel()
+		<-s.slots
+	}, nil
+}
+
+func (s limitedSource) FetchHistogramAll(ctx context.Context, interval int64) (histogram.Histogram, error) {
+	ctx, release, err := s.acquire(ctx)
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+	defer release()
+	return s.source.FetchHistogramAll(ctx, interval)
+}
+
+func (s limitedSource) FetchHistogramRange(ctx context.Context, gte, lt, interval int64) (histogram.Histogram, error) {
+	ctx, release, err := s.acquire(ctx)
+	if err != nil {
+		return histogram.Histogram{}, err
+	}
+	defer release()
+	return s.source.FetchHistogramRange(ctx, gte, lt, interval)
+}
+
+func (s limitedSource) FetchIDRange(ctx context.Context, gte, lt int64) ([]int64, error) {
+	ctx, release, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return s.source.FetchIDRange(ctx, gte, lt)
+}
+
+// ChecksumsEnabled returns true if the wrapped source implements datasource.Checksummer and has checksums enabled
+func (s limitedSource) ChecksumsEnabled() bool {
+	c, ok := s.source.(datasource.Checksummer)
+	return ok && c.ChecksumsEnabled()
+}
+
+// ChecksumEngine returns the engine of the wrapped source, or nothing when it does not implement datasource.Checksummer
+func (s limitedSource) ChecksumEngine() string {
+	c, ok := s.source.(datasource.Checksummer)
+	if !ok {
+		return ""
+	}
+	return c.ChecksumEngine()
+}
+
+func (s limitedSource) FetchChecksumRange(ctx context.Context, gte, lt int64) (map[int64]uint32, error) {
+	c, ok := s.source.(datasource.Checksummer)
+	if !ok {
+		return nil, fmt.Errorf("Data source does not support checksums")
+	}
+	ctx, release, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.FetchChecksumRange(ctx, gte, lt)
+}
+
+// FetchesRecords returns true if the wrapped source fetches records
+func (s limitedSource) FetchesRecords() bool {
+	return datasource.FetchesRecords(s.source)
+}
+
+func (s limitedSource) FetchRecordRange(ctx context.Context, gte, lt int64, fields []string) (map[int64]datasource.Record, error) {
+	r, ok := s.source.(datasource.RecordFetcher)
+	if !ok {
+		return nil, fmt.Errorf("Data source does not support fetching records")
+	}
+	ctx, release, err := s.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return r.FetchRecordRange(ctx, gte, lt, fields)
+}
+
+var _ datasource.DataSource = limitedSource{}
+var _ datasource.Checksummer = limitedSource{}
+var _ datasource.RecordFetcher = limitedSource{}
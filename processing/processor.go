@@ -1,110 +1,538 @@
 package processing
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/arturom/datadiff/datasource"
 	"github.com/arturom/datadiff/histogram"
+	"golang.org/x/sync/errgroup"
 )
 
-func Process(primary, secondary datasource.DataSource, interval int) error {
-	// fmt.Printf("FetchAll    Interval: %2d\n", interval)
-	priHistogram, err := primary.FetchHistogramAll(interval)
+// Options configures how data sources are compared
+type Options struct {
+	// Interval is the bin size of the initial histograms
+	Interval int64
+	// Branching is the number of sub-bins every unresolved bin is split into
+	Branching int
+	// PrimaryConcurrency limits the number of concurrent queries to the primary source
+	PrimaryConcurrency int
+	// SecondaryConcurrency limits the number of concurrent queries to the secondary source
+	SecondaryConcurrency int
+	// QueryTimeout bounds every individual query when it is greater than zero
+	QueryTimeout time.Duration
+	// Fields are compared record by record once a range is narrowed down to single IDs.
+	// Both sources must implement datasource.RecordFetcher when any field is given.
+	Fields []FieldMapping
+	// Checkpoint persists the top-level bins as they are resolved when it is set
+	Checkpoint *Checkpoint
+	// Incremental reuses the results of the previous run for the bins that have not changed when it is set
+	Incremental *Incremental
+	// Recheck re-verifies every difference before it is reported when it is set
+	Recheck *Recheck
+	// OverCapacity receives the top-level bins holding duplicate IDs as soon as they are found, when it is set
+	OverCapacity func(b OverCapacity) error
+}
+
+// Source names a data source compared by ProcessAll
+type Source struct {
+	Name       string
+	DataSource datasource.DataSource
+	// Concurrency limits the number of concurrent queries to the source
+	Concurrency int
+}
+
+// Process compares two data sources starting with bins of the given interval. Every unresolved
+// bin is split into smaller bins by the branching factor until single IDs can be compared.
+// The sub-bins of every bin are drilled into concurrently, at most as many at once as the largest concurrency
+// of the sources, but differences are passed to the handler in ID order. The differences of every top-level bin are
+// passed as soon as the bins before it are resolved, so they are reported while the rest is still compared.
+// Cancelling the context stops all queries in flight.
+// When both sources have checksums enabled, bins with matching counts but different checksums are
+// drilled into as well and the records whose content differs are reported as modified.
+// With a checkpoint, the bins resolved by an interrupted run are not compared again when resuming.
+// Incremental runs only drill into the bins whose counts changed since the baseline of the previous run.
+// With a recheck, only the differences found again after the settle delay are reported, so they are all held
+// until the recheck passes are over.
+func Process(ctx context.Context, primary, secondary datasource.DataSource, o Options, handle Handler) error {
+	return ProcessAll(ctx, []Source{
+		{Name: Primary.String(), DataSource: primary, Concurrency: o.PrimaryConcurrency},
+		{Name: Secondary.String(), DataSource: secondary, Concurrency: o.SecondaryConcurrency},
+	}, o, handle)
+}
+
+// ProcessAll compares any number of data sources the way Process compares two, drilling into every bin whose
+// counts or checksums are not the same in all of them. Two sources are reported like in Process, the first
+// being the primary. With more, every ID not held by all the sources is reported as missing along with the
+// names of the sources holding it, and duplicates name the source duplicating them. Field comparison only
+// applies to two sources, and the concurrency options are replaced by the concurrency of every source.
+func ProcessAll(ctx context.Context, sources []Source, o Options, handle Handler) error {
+	if len(sources) < 2 {
+		return fmt.Errorf("At least two sources must be compared")
+	}
+	if o.Interval < 1 || o.Branching < 2 {
+		return fmt.Errorf("Interval must be positive and branching factor at least 2")
+	}
+	p := processor{
+		branching: int64(o.Branching),
+		fields:    o.Fields,
+		overCap:   o.OverCapacity,
+	}
+	seen := make(map[string]bool)
+	for _, s := range sources {
+		if s.Name == "" || seen[s.Name] {
+			return fmt.Errorf("Source names must be unique and not empty")
+		}
+		seen[s.Name] = true
+		p.names = append(p.names, s.Name)
+		p.sources = append(p.sources, newLimitedSource(s.DataSource, s.Concurrency, o.QueryTimeout))
+		p.limit = max(p.limit, s.Concurrency, 1)
+	}
+	p.checksums = p.sources[0].ChecksumsEnabled()
+	for _, s := range p.sources {
+		if s.ChecksumsEnabled() != p.checksums {
+			return fmt.Errorf("Checksums must be configured on every source")
+		}
+		if p.checksums && (s.ChecksumEngine() == "" || s.ChecksumEngine() != p.sources[0].ChecksumEngine()) {
+			return fmt.Errorf("Checksums are only comparable between sources of the same engine")
+		}
+	}
+	if len(p.fields) != 0 {
+		if len(p.sources) != 2 {
+			return fmt.Errorf("Field comparison only applies to two sources")
+		}
+		for _, s := range p.sources {
+			if !s.FetchesRecords() {
+				return fmt.Errorf("Field comparison requires both sources to support fetching records")
+			}
+		}
+	}
+	if o.Checkpoint != nil {
+		j, err := openJournal(o.Checkpoint, o.Interval, o.Branching)
+		if err != nil {
+			return err
+		}
+		defer j.close()
+		p.journal = j
+	}
+	if o.Incremental != nil {
+		b, err := loadBaseline(o.Incremental, o.Interval, o.Branching)
+		if err != nil {
+			return err
+		}
+		p.baseline = b
+	}
+	// Differences are streamed to the handler unless they are rechecked first, and kept for the baseline
+	var out *ordered
+	if o.Recheck == nil {
+		out = &ordered{handle: handle, keep: o.Incremental != nil}
+	}
+	diffs, pyramid, err := p.process(ctx, o.Interval, out)
 	if err != nil {
 		return err
 	}
-	secHistogram, err := secondary.FetchHistogramAll(interval)
+	if o.Recheck != nil {
+		diffs, err = recheck(ctx, diffs, o.Recheck, p.limit, p.recheckRange)
+		if err != nil {
+			return err
+		}
+	}
+	if o.Incremental != nil {
+		err = saveBaseline(o.Incremental, &baseline{
+			Config:      o.Incremental.Config,
+			Interval:    o.Interval,
+			Branching:   o.Branching,
+			Pyramid:     pyramid,
+			Differences: diffs,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if out != nil {
+		return nil
+	}
+	for _, d := range diffs {
+		err = handle(d)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type processor struct {
+	sources   []limitedSource
+	names     []string
+	branching int64
+	// limit bounds the number of bins drilled into at once by every bin, since the sources cannot run more queries at once
+	limit     int
+	checksums bool
+	fields    []FieldMapping
+	journal   *journal
+	baseline  *baseline
+	overCap   func(b OverCapacity) error
+}
+
+// all runs a fetch against every source concurrently and returns the first error
+func (p processor) all(ctx context.Context, fetch func(ctx context.Context, i int, s limitedSource) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	for i, s := range p.sources {
+		i, s := i, s
+		g.Go(func() error {
+			return fetch(ctx, i, s)
+		})
+	}
+	return g.Wait()
+}
+
+func (p processor) process(ctx context.Context, interval int64, out *ordered) ([]Difference, *histogram.Pyramid, error) {
+	// fmt.Printf("FetchAll    Interval: %2d\n", interval)
+	hs := make([]histogram.Histogram, len(p.sources))
+	err := p.all(ctx, func(ctx context.Context, i int, s limitedSource) (err error) {
+		hs[i], err = s.FetchHistogramAll(ctx, interval)
+		return
+	})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	/*
-		fmt.Printf(
-			"|%9s | %9s | %9s | %9s | %9s | %9s |\n",
-			"Interval", "Min", "Max", "Primary", "Secondary", "Diff")
-	*/
-	return processHistograms(priHistogram, secHistogram, primary, secondary, interval)
+	if p.overCap != nil {
+		for _, bin := range histogram.MergeAll(math.MinInt64, math.MaxInt64, hs...).UnresolvedBins() {
+			for _, i := range bin.OverCapacity() {
+				err = p.overCap(OverCapacity{
+					Source:     p.names[i],
+					RangeStart: bin.Gte,
+					RangeEnd:   bin.Lt,
+					Count:      bin.Counts[i],
+				})
+				if err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+	var base *histogram.Pyramid
+	if p.baseline != nil {
+		base = p.baseline.Pyramid
+	}
+	return p.processHistograms(ctx, hs, math.MinInt64, math.MaxInt64, p.journal, base, out)
 }
 
-func fetchRange(primary, secondary datasource.DataSource, gte, lt, interval int) error {
+func (p processor) fetchRange(ctx context.Context, gte, lt, interval int64, base *histogram.Pyramid) ([]Difference, *histogram.Pyramid, error) {
 	// fmt.Printf("FetchRange  Interval: %3d  gte: %3d  lt: %3d\n", interval, gte, lt)
-	priHistogram, err := primary.FetchHistogramRange(gte, lt, interval)
+	hs := make([]histogram.Histogram, len(p.sources))
+	err := p.all(ctx, func(ctx context.Context, i int, s limitedSource) (err error) {
+		hs[i], err = s.FetchHistogramRange(ctx, gte, lt, interval)
+		return
+	})
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	return p.processHistograms(ctx, hs, gte, lt, nil, base, nil)
+}
+
+// processHistograms drills into the unresolved bins, clamped to the range the histograms were fetched for
+// since the top-level bins may extend past the range of the sources and the last sub-bin past the bin it splits.
+// Bins are looked up in and recorded to the journal when one is given. Bins unchanged since the
+// baseline pyramid given reuse the differences of the baseline, and the pyramid of this run is returned.
+// The differences of every bin are passed to out as soon as it is resolved when it is given, and only
+// returned when out keeps them.
+func (p processor) processHistograms(ctx context.Context, hs []histogram.Histogram, gte, lt int64, j *journal, base *histogram.Pyramid, out *ordered) ([]Difference, *histogram.Pyramid, error) {
+	node := histogram.NewPyramid(hs...)
+	bins := histogram.MergeAll(gte, lt, hs...).UnresolvedBins()
+	results := make([][]Difference, len(bins))
+	children := make([]*histogram.Pyramid, len(bins))
+	journaled := make([]bool, len(bins))
+	if out != nil {
+		out.expect(len(bins))
+	}
+	resolve := func(i int, diffs []Difference) error {
+		results[i] = diffs
+		if out == nil {
+			return nil
+		}
+		if !out.keep {
+			results[i] = nil
+		}
+		return out.resolve(i, diffs)
 	}
-	secHistogram, err := secondary.FetchHistogramRange(gte, lt, interval)
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(p.limit)
+	for i, bin := range bins {
+		i, bin := i, bin
+		if j != nil {
+			if diffs, ok := j.lookup(bin.Key); ok {
+				journaled[i] = true
+				g.Go(func() error {
+					return resolve(i, diffs)
+				})
+				continue
+			}
+		}
+		var childBase *histogram.Pyramid
+		if base != nil {
+			child, ok := base.Drilled(bin.Key)
+			if ok && base.Unchanged(bin) {
+				children[i] = child
+				g.Go(func() error {
+					return resolve(i, p.baseline.differencesInRange(bin.Gte, bin.Lt))
+				})
+				continue
+			}
+			childBase = child
+		}
+		g.Go(func() error {
+			diffs, child, err := p.fetchNext(ctx, bin, childBase)
+			if err != nil {
+				return err
+			}
+			children[i] = child
+			if j != nil {
+				err = j.record(bin.Key, diffs)
+				if err != nil {
+					return err
+				}
+			}
+			return resolve(i, diffs)
+		})
+	}
+	err := g.Wait()
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	return processHistograms(priHistogram, secHistogram, primary, secondary, interval)
-}
 
-func processHistograms(priHistogram, secHistogram histogram.Histogram, primary, secondary datasource.DataSource, interval int) error {
-	merged := priHistogram.Merge(secHistogram)
-	// printMergedSummary(merged, interval)
-	for _, pair := range merged.UnresolvedPairs() {
-		err := fetchNext(primary, secondary, pair.Key, pair.Key+interval, interval/10)
-		if err != nil {
-			return err
+	// Concatenate in bin order so the output does not depend on scheduling
+	var diffs []Difference
+	for i, r := range results {
+		diffs = append(diffs, r...)
+		// Bins resolved from the journal were not drilled into by this run, so the pyramid leaves them out
+		if !journaled[i] {
+			node.Children[bins[i].Key] = children[i]
 		}
 	}
-	return nil
+	return diffs, node, nil
 }
 
-func fetchIDs(primary, secondary datasource.DataSource, gte, lt int) error {
-	// fmt.Printf("FetchIDs   gte: %3d  lt: %3d\n", gte, lt)
-	primaryIDs, err := primary.FetchIDRange(gte, lt)
-	if err != nil {
-		return err
+// fetchNext drills into the range of an unresolved bin with a smaller histogram, or compares its records once bins can no longer be split
+// The range is split into as many contiguous sub-bins as the branching factor, all of the same size but the last which may be shorter.
+// The pyramid of the range is returned along with its differences, and is nil once records are compared directly.
+func (p processor) fetchNext(ctx context.Context, bin histogram.MultiBin, base *histogram.Pyramid) ([]Difference, *histogram.Pyramid, error) {
+	interval := subInterval(bin.Capacity(), p.branching)
+	// fmt.Printf("FetchNext   Interval: %9d  gte: %9d  lt: %9d\n", interval, bin.Gte, bin.Lt)
+	if interval > 1 {
+		return p.fetchRange(ctx, bin.Gte, bin.Lt, interval, base)
 	}
-	secondaryIds, err := secondary.FetchIDRange(gte, lt)
-	if err != nil {
-		return err
+	diffs, err := p.fetchRecords(ctx, bin, bin.Gte, bin.Lt)
+	return diffs, nil, err
+}
+
+// subInterval returns the size of the sub-bins splitting a range into at most branching sub-bins, rounding up
+func subInterval(size, branching int64) int64 {
+	interval := size / branching
+	if size%branching != 0 {
+		interval++
 	}
+	return interval
+}
 
-	m := make(map[int]int)
-	for _, id := range primaryIDs {
-		m[id] = -1
+// recheckRange compares the records of a range again. Duplicates are looked for by making the counts exceed
+// any number of records fetched.
+func (p processor) recheckRange(ctx context.Context, gte, lt int64, duplicates bool) ([]Difference, error) {
+	bin := histogram.MultiBin{Key: gte, Gte: gte, Lt: lt, Counts: make([]int64, len(p.sources))}
+	if duplicates {
+		for i := range bin.Counts {
+			bin.Counts[i] = math.MaxInt64
+		}
 	}
-	for _, id := range secondaryIds {
-		_, ok := m[id]
-		if ok {
-			m[id] = 0
+	return p.fetchRecords(ctx, bin, gte, lt)
+}
+
+// fetchRecords compares the records of a range by their IDs, their checksums when enabled or their mapped fields
+// when any is given. Checksums and records are keyed by ID, so duplicates are only visible through the counts:
+// the IDs are fetched as well from the sources whose bin counts exceed the number of records.
+func (p processor) fetchRecords(ctx context.Context, bin histogram.MultiBin, gte, lt int64) ([]Difference, error) {
+	counts := make([]map[int64]int64, len(p.sources))
+	checksums := make([]map[int64]uint32, len(p.sources))
+	records := make([]map[int64]datasource.Record, len(p.sources))
+	err := p.all(ctx, func(ctx context.Context, i int, s limitedSource) error {
+		var keys []int64
+		keyed := true
+		if len(p.fields) != 0 {
+			r, err := s.FetchRecordRange(ctx, gte, lt, p.recordFields(i))
+			if err != nil {
+				return err
+			}
+			records[i] = r
+			for id := range r {
+				keys = append(keys, id)
+			}
+		} else if p.checksums {
+			c, err := s.FetchChecksumRange(ctx, gte, lt)
+			if err != nil {
+				return err
+			}
+			checksums[i] = c
+			for id := range c {
+				keys = append(keys, id)
+			}
 		} else {
-			m[id] = 1
+			keyed = false
 		}
+
+		if !keyed || bin.Counts[i] > int64(len(keys)) {
+			ids, err := s.FetchIDRange(ctx, gte, lt)
+			if err != nil {
+				return err
+			}
+			keys = ids
+		}
+		counts[i] = countIDs(keys)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// w := csv.NewWriter(os.Stdout)
-	for id, flag := range m {
-		if flag != 0 {
-			/*
-				values := []string{strconv.Itoa(id), strconv.Itoa(flag)}
-				if err = w.Write(values); err != nil {
-					return nil
-				}
-			*/
-			fmt.Printf("%d,%d\n", id, flag)
+	var diffs []Difference
+	for _, id := range unionIDs(counts) {
+		var holders []int
+		for i, c := range counts {
+			if c[id] > 0 {
+				holders = append(holders, i)
+			}
+		}
+		d := Difference{ID: id, RangeStart: gte, RangeEnd: lt}
+		if len(holders) < len(p.sources) {
+			d.Type = Missing
+			p.nameHolders(&d, holders)
+			diffs = append(diffs, d)
+		} else if len(p.fields) != 0 {
+			if fields := compareRecords(p.fields, records[0][id], records[1][id]); len(fields) != 0 {
+				d.Type = Modified
+				d.Fields = fields
+				diffs = append(diffs, d)
+			}
+		} else if p.checksums && !checksumsMatch(checksums, id) {
+			d.Type = Modified
+			p.nameHolders(&d, holders)
+			diffs = append(diffs, d)
+		}
+		for i, c := range counts {
+			if c[id] > 1 {
+				diffs = append(diffs, p.duplicate(id, i, c[id], gte, lt))
+			}
 		}
 	}
-	// w.Flush()
+	sortDifferences(diffs)
 
-	return nil
+	return diffs, nil
 }
 
-func printMergedSummary(merged histogram.MergedHistogram, interval int) {
-	for _, b := range merged.UnresolvedPairs() {
-		diff := b.DiffCount()
-		fmt.Printf(
-			"|%9d | %9d | %9d | %9d | %9d | %9d |\n",
-			interval, b.Key, b.Key+interval-1, b.CountFromPrimary, b.CountFromSecondary, diff)
+// recordFields returns the fields fetched from a source for field comparison
+func (p processor) recordFields(source int) []string {
+	fields := make([]string, len(p.fields))
+	for i, f := range p.fields {
+		if source == 0 {
+			fields[i] = f.Primary
+		} else {
+			fields[i] = f.secondary()
+		}
 	}
+	return fields
 }
 
-func fetchNext(primary, secondary datasource.DataSource, gte, lt, interval int) error {
-	// fmt.Printf("FetchNext   Interval: %9d  gte: %9d  lt: %9d\n", interval, gte, lt)
-	if interval > 1 {
-		return fetchRange(primary, secondary, gte, lt, interval)
+// nameHolders tells which sources hold an ID. With two sources the one missing it is set as MissingFrom,
+// otherwise the names of the holders are listed in Sources.
+func (p processor) nameHolders(d *Difference, holders []int) {
+	if len(p.sources) == 2 {
+		if d.Type == Missing {
+			d.MissingFrom = Side(1 - holders[0])
+		}
+		return
+	}
+	for _, i := range holders {
+		d.Sources = append(d.Sources, p.names[i])
+	}
+}
+
+// duplicate reports an ID held more than once by a source
+func (p processor) duplicate(id int64, source int, occurrences, gte, lt int64) Difference {
+	d := Difference{
+		ID:          id,
+		Type:        Duplicate,
+		Occurrences: occurrences,
+		RangeStart:  gte,
+		RangeEnd:    lt,
+	}
+	if len(p.sources) == 2 {
+		d.DuplicatedIn = Side(source)
 	} else {
-		return fetchIDs(primary, secondary, gte, lt)
+		d.Sources = []string{p.names[source]}
+	}
+	return d
+}
+
+func countIDs(ids []int64) map[int64]int64 {
+	counts := make(map[int64]int64, len(ids))
+	for _, id := range ids {
+		counts[id]++
 	}
+	return counts
+}
+
+// unionIDs returns every ID counted in any source, sorted
+func unionIDs(counts []map[int64]int64) []int64 {
+	var ids []int64
+	seen := make(map[int64]bool)
+	for _, c := range counts {
+		for id := range c {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// checksumsMatch returns true if every source holds the same checksum for an ID held by all of them
+func checksumsMatch(checksums []map[int64]uint32, id int64) bool {
+	for _, c := range checksums {
+		if c[id] != checksums[0][id] {
+			return false
+		}
+	}
+	return true
+}
+
+// sortDifferences orders differences by ID, then by type and side since an ID may be reported more than once
+func sortDifferences(diffs []Difference) {
+	sort.Slice(diffs, func(i, j int) bool {
+		a, b := diffs[i], diffs[j]
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Type == Missing {
+			return a.MissingFrom < b.MissingFrom
+		}
+		if a.Type == Duplicate {
+			if a.DuplicatedIn != b.DuplicatedIn {
+				return a.DuplicatedIn < b.DuplicatedIn
+			}
+			return strings.Join(a.Sources, ",") < strings.Join(b.Sources, ",")
+		}
+		return false
+	})
 }
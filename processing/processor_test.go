@@ -0,0 +1,321 @@
+package processing
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/arturom/datadiff/datasource"
+)
+
+// sqliteTable writes a table of records to a new SQLite file and returns its path. The table has no
+// primary key so that it can hold duplicate IDs.
+func sqliteTable(t *testing.T, name string, ids []int64, names map[int64]string) string {
+	path := filepath.Join(t.TempDir(), name+".db")
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	_, err = db.Exec(`CREATE TABLE "records" ("id" INTEGER, "name" TEXT)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		n, ok := names[id]
+		if !ok {
+			n = fmt.Sprint("record ", id)
+		}
+		_, err = tx.Exec(`INSERT INTO "records" VALUES (?, ?)`, id, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// idRange returns the IDs from gte up to lt, leaving out the skipped ones
+func idRange(gte, lt int64, skip ...int64) []int64 {
+	skipped := make(map[int64]bool)
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	var ids []int64
+	for id := gte; id < lt; id++ {
+		if !skipped[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func openSqlite(t *testing.T, path, config string) datasource.DataSource {
+	s, err := datasource.DataSourceFactory{}.Create("sqlite", path, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// compare runs Process on two SQLite files and returns the differences it reports
+func compare(t *testing.T, primary, secondary, config string, o Options) []Difference {
+	var diffs []Difference
+	err := Process(context.Background(), openSqlite(t, primary, config), openSqlite(t, secondary, config), o, func(d Difference) error {
+		diffs = append(diffs, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return diffs
+}
+
+// summarize strips the ranges from differences, which depend on how bins were drilled into
+func summarize(diffs []Difference) []Difference {
+	out := make([]Difference, len(diffs))
+	for i, d := range diffs {
+		d.RangeStart, d.RangeEnd = 0, 0
+		out[i] = d
+	}
+	return out
+}
+
+const sqliteConfig = `{"table_name":"records", "field_name":"id"}`
+
+func TestProcessDrillsDownToMissingIDs(t *testing.T) {
+	primary := sqliteTable(t, "primary", idRange(-5000, 50000, -4321, 17, 31999), nil)
+	secondary := sqliteTable(t, "secondary", append(idRange(-5000, 50000, 42), 90000), nil)
+
+	got := compare(t, primary, secondary, sqliteConfig, Options{Interval: 1000, Branching: 10})
+	want := []Difference{
+		{ID: -4321, Type: Missing, MissingFrom: Primary},
+		{ID: 17, Type: Missing, MissingFrom: Primary},
+		{ID: 42, Type: Missing, MissingFrom: Secondary},
+		{ID: 31999, Type: Missing, MissingFrom: Primary},
+		{ID: 90000, Type: Missing, MissingFrom: Primary},
+	}
+	if !reflect.DeepEqual(summarize(got), want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for _, d := range got {
+		if d.ID < d.RangeStart || d.ID >= d.RangeEnd {
+			t.Errorf("ID %d outside of its range [%d, %d)", d.ID, d.RangeStart, d.RangeEnd)
+		}
+	}
+}
+
+func TestProcessBranchingOfPrimeIntervals(t *testing.T) {
+	// 997 is prime, so its bins are split into sub-bins of 250, 250, 250 and 247 IDs, and so on down
+	primary := sqliteTable(t, "primary", idRange(0, 5000, 2500), nil)
+	secondary := sqliteTable(t, "secondary", idRange(0, 5000), nil)
+
+	got := compare(t, primary, secondary, sqliteConfig, Options{Interval: 997, Branching: 4})
+	if want := []Difference{{ID: 2500, Type: Missing, MissingFrom: Primary}}; !reflect.DeepEqual(summarize(got), want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// The IDs are only compared once the bins are drilled into ranges no wider than the branching factor
+	if d := got[0]; d.RangeStart > d.ID || d.RangeEnd <= d.ID || d.RangeEnd-d.RangeStart > 4 {
+		t.Errorf("compared the IDs of [%d, %d), want a range of at most 4 IDs holding %d", d.RangeStart, d.RangeEnd, d.ID)
+	}
+}
+
+func TestProcessReportsDuplicates(t *testing.T) {
+	primary := sqliteTable(t, "primary", idRange(0, 10000), nil)
+	secondary := sqliteTable(t, "secondary", append(idRange(0, 10000, 700), 55, 55, 8000), nil)
+
+	got := compare(t, primary, secondary, sqliteConfig, Options{Interval: 1000, Branching: 10})
+	want := []Difference{
+		{ID: 55, Type: Duplicate, DuplicatedIn: Secondary, Occurrences: 3},
+		{ID: 700, Type: Missing, MissingFrom: Secondary},
+		{ID: 8000, Type: Duplicate, DuplicatedIn: Secondary, Occurrences: 2},
+	}
+	if !reflect.DeepEqual(summarize(got), want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProcessComparesChecksums(t *testing.T) {
+	primary := sqliteTable(t, "primary", idRange(0, 10000), nil)
+	secondary := sqliteTable(t, "secondary", idRange(0, 10000, 9999), map[int64]string{300: "changed", 6001: "changed"})
+	config := `{"table_name":"records", "field_name":"id", "checksum_fields":["name"]}`
+
+	got := compare(t, primary, secondary, config, Options{Interval: 1000, Branching: 10})
+	want := []Difference{
+		{ID: 300, Type: Modified},
+		{ID: 6001, Type: Modified},
+		{ID: 9999, Type: Missing, MissingFrom: Secondary},
+	}
+	if !reflect.DeepEqual(summarize(got), want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Without checksums, the modified records go unnoticed
+	got = compare(t, primary, secondary, sqliteConfig, Options{Interval: 1000, Branching: 10})
+	if want := want[2:]; !reflect.DeepEqual(summarize(got), want) {
+		t.Errorf("got %v without checksums, want %v", got, want)
+	}
+}
+
+// engineSource checksums like the SQLite source it wraps while claiming another engine renders its fields
+type engineSource struct {
+	datasource.SqliteDataSource
+	engine string
+}
+
+func (s engineSource) ChecksumEngine() string {
+	return s.engine
+}
+
+func TestProcessRefusesChecksumsOfDifferentEngines(t *testing.T) {
+	config := `{"table_name":"records", "field_name":"id", "checksum_fields":["name"]}`
+	primary := openSqlite(t, sqliteTable(t, "primary", idRange(0, 100), nil), config)
+	secondary := openSqlite(t, sqliteTable(t, "secondary", idRange(0, 100), nil), config)
+	handle := func(d Difference) error {
+		return nil
+	}
+
+	err := Process(context.Background(), primary, engineSource{secondary.(datasource.SqliteDataSource), "mysql"}, Options{Interval: 10, Branching: 10}, handle)
+	if err == nil || !strings.Contains(err.Error(), "same engine") {
+		t.Errorf("got error %v, want checksums of different engines refused", err)
+	}
+	err = Process(context.Background(), primary, engineSource{secondary.(datasource.SqliteDataSource), "sqlite"}, Options{Interval: 10, Branching: 10}, handle)
+	if err != nil {
+		t.Errorf("got error %v, want checksums of the same engine compared", err)
+	}
+}
+
+func TestProcessComparesFields(t *testing.T) {
+	primary := sqliteTable(t, "primary", idRange(0, 10000), nil)
+	secondary := sqliteTable(t, "secondary", idRange(0, 10000), map[int64]string{4242: "changed"})
+	config := `{"table_name":"records", "field_name":"id", "checksum_fields":["name"]}`
+
+	got := compare(t, primary, secondary, config, Options{
+		Interval:  1000,
+		Branching: 10,
+		Fields:    []FieldMapping{{Primary: "name"}},
+	})
+	if want := []Difference{{ID: 4242, Type: Modified, Fields: []string{"name"}}}; !reflect.DeepEqual(summarize(got), want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// unsignedFile writes unsigned IDs to a new text file and opens it as a source of unsigned IDs
+func unsignedFile(t *testing.T, name string, ids []uint64) datasource.DataSource {
+	var b strings.Builder
+	for _, id := range ids {
+		fmt.Fprintln(&b, id)
+	}
+	path := filepath.Join(t.TempDir(), name+".txt")
+	err := os.WriteFile(path, []byte(b.String()), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := datasource.DataSourceFactory{Unsigned: true}.Create("file", path, `{"in_memory":true}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestProcessComparesUnsignedIDs(t *testing.T) {
+	// IDs around 2^63 and up to 2^64 - 2, past the signed range
+	var ids []uint64
+	for id := uint64(1<<63 - 3000); id < 1<<63+3000; id++ {
+		ids = append(ids, id)
+	}
+	for id := uint64(math.MaxUint64 - 2000); id < math.MaxUint64; id++ {
+		ids = append(ids, id)
+	}
+	primary := unsignedFile(t, "primary", append(ids, 7))
+	secondary := unsignedFile(t, "secondary", append(slices.Delete(slices.Clone(ids), 3000, 3001), math.MaxUint64-1))
+
+	var got []uint64
+	err := Process(context.Background(), primary, secondary, Options{Interval: 1000, Branching: 10}, func(d Difference) error {
+		if d.ID < d.RangeStart || d.ID >= d.RangeEnd {
+			t.Errorf("ID %d outside of its range [%d, %d)", d.ID, d.RangeStart, d.RangeEnd)
+		}
+		got = append(got, datasource.UnsignedID(d.ID))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 7 and 2^63 are missing from the secondary source, and 2^64 - 2 is duplicated in it
+	slices.Sort(got)
+	if want := []uint64{7, 1 << 63, math.MaxUint64 - 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProcessIdenticalSources(t *testing.T) {
+	primary := sqliteTable(t, "primary", idRange(0, 10000), nil)
+	secondary := sqliteTable(t, "secondary", idRange(0, 10000), nil)
+
+	if got := compare(t, primary, secondary, sqliteConfig, Options{Interval: 1000, Branching: 10}); len(got) != 0 {
+		t.Errorf("got %v, want no differences", got)
+	}
+}
+
+func TestProcessAllFindsDifferencesInOneSource(t *testing.T) {
+	full := idRange(0, 10000)
+	sources := []Source{
+		{Name: "a", DataSource: openSqlite(t, sqliteTable(t, "a", full, nil), sqliteConfig)},
+		{Name: "b", DataSource: openSqlite(t, sqliteTable(t, "b", full, nil), sqliteConfig)},
+		{Name: "c", DataSource: openSqlite(t, sqliteTable(t, "c", append(idRange(0, 10000, 1234, 8765), 77), nil), sqliteConfig)},
+		{Name: "d", DataSource: openSqlite(t, sqliteTable(t, "d", full, nil), sqliteConfig)},
+	}
+
+	var got []Difference
+	err := ProcessAll(context.Background(), sources, Options{Interval: 1000, Branching: 10}, func(d Difference) error {
+		got = append(got, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Difference{
+		{ID: 77, Type: Duplicate, Occurrences: 2, Sources: []string{"c"}},
+		{ID: 1234, Type: Missing, Sources: []string{"a", "b", "d"}},
+		{ID: 8765, Type: Missing, Sources: []string{"a", "b", "d"}},
+	}
+	if !reflect.DeepEqual(summarize(got), want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestProcessAllFindsChecksumsDifferingInOneSource(t *testing.T) {
+	config := `{"table_name":"records", "field_name":"id", "checksum_fields":["name"]}`
+	full := idRange(0, 5000)
+	sources := []Source{
+		{Name: "a", DataSource: openSqlite(t, sqliteTable(t, "a", full, nil), config)},
+		{Name: "b", DataSource: openSqlite(t, sqliteTable(t, "b", full, map[int64]string{4000: "changed"}), config)},
+		{Name: "c", DataSource: openSqlite(t, sqliteTable(t, "c", full, nil), config)},
+	}
+
+	var got []Difference
+	err := ProcessAll(context.Background(), sources, Options{Interval: 1000, Branching: 10}, func(d Difference) error {
+		got = append(got, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Difference{{ID: 4000, Type: Modified, Sources: []string{"a", "b", "c"}}}; !reflect.DeepEqual(summarize(got), want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,116 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Recheck re-verifies the differences found before they are reported, so that records still being
+// replicated to an eventually consistent source are not reported as missing or modified
+type Recheck struct {
+	// Delay is waited before every recheck pass to let replication settle
+	Delay time.Duration
+	// Repeats is the number of passes run after the first one. Only the IDs found to differ by every pass
+	// are reported, with the differences found by the last pass since they are the latest observation.
+	Repeats int
+	// Transient receives the differences that disappeared in a recheck pass, when it is set
+	Transient Handler
+}
+
+// recheckFetch compares the records of a range again, skipping the histograms since they cannot tell modified
+// records apart. Duplicates are only looked for when requested, since finding them takes fetching the IDs on
+// top of the checksums or records.
+type recheckFetch func(ctx context.Context, gte, lt int64, duplicates bool) ([]Difference, error)
+
+// recheckRange is a range holding differences, compared again by a single fetch
+type recheckRange struct {
+	gte, lt    int64
+	duplicates bool
+}
+
+// recheck compares the ranges holding differences again, running at most limit fetches at once. The IDs found to differ
+// by every pass are returned, along with the differences found by the last pass since an ID may differ another way
+// once replication catches up, like a missing record that turns out to be modified.
+func recheck(ctx context.Context, diffs []Difference, r *Recheck, limit int, fetch recheckFetch) ([]Difference, error) {
+	for pass := 0; pass <= r.Repeats && len(diffs) != 0; pass++ {
+		select {
+		case <-time.After(r.Delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// Differences are batched by the range they were found in, which bounds the records fetched again
+		var ranges []recheckRange
+		index := make(map[[2]int64]int)
+		candidates := make(map[int64]bool)
+		for _, d := range diffs {
+			candidates[d.ID] = true
+			key := [2]int64{d.RangeStart, d.RangeEnd}
+			i, ok := index[key]
+			if !ok {
+				i = len(ranges)
+				index[key] = i
+				ranges = append(ranges, recheckRange{gte: d.RangeStart, lt: d.RangeEnd})
+			}
+			if d.Type == Duplicate {
+				ranges[i].duplicates = true
+			}
+		}
+
+		results := make([][]Difference, len(ranges))
+		g, ctx := errgroup.WithContext(ctx)
+		g.SetLimit(limit)
+		for i, rr := range ranges {
+			i, rr := i, rr
+			g.Go(func() (err error) {
+				results[i], err = fetch(ctx, rr.gte, rr.lt, rr.duplicates)
+				return
+			})
+		}
+		err := g.Wait()
+		if err != nil {
+			return nil, err
+		}
+
+		// The differences of IDs that were not candidates appeared after the comparison, so they are left to the next run
+		var found []Difference
+		foundKeys := make(map[string]bool)
+		for _, res := range results {
+			for _, d := range res {
+				key := differenceKey(d)
+				if candidates[d.ID] && !foundKeys[key] {
+					found = append(found, d)
+					foundKeys[key] = true
+				}
+			}
+		}
+		if r.Transient != nil {
+			for _, d := range diffs {
+				if !foundKeys[differenceKey(d)] {
+					err = r.Transient(d)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+		sortDifferences(found)
+		diffs = found
+	}
+	return diffs, nil
+}
+
+// differenceKey identifies what a difference is about rather than how the records differ, so that an ID still
+// differing another way in a later pass is not reported as transient. The records of an ID across the sources are
+// keyed by the ID alone, since a missing record may turn out to be modified or missing from another source as
+// replication catches up, while the duplicates of an ID are keyed by the source holding them.
+func differenceKey(d Difference) string {
+	if d.Type == Duplicate {
+		return fmt.Sprintf("%d|%s|%s", d.ID, d.DuplicatedIn, strings.Join(d.Sources, ","))
+	}
+	return fmt.Sprint(d.ID)
+}
@@ -0,0 +1,133 @@
+package processing
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// scriptedSource answers every recheck pass over a range with the differences of the next of its passes, like
+// a source whose contents change between fetches, and records when each range was fetched. The last pass is
+// repeated once they run out.
+type scriptedSource struct {
+	passes [][]Difference
+
+	mu      sync.Mutex
+	fetched map[[2]int64]int
+	fetches []time.Time
+}
+
+func (s *scriptedSource) fetch(ctx context.Context, gte, lt int64, duplicates bool) ([]Difference, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fetched == nil {
+		s.fetched = make(map[[2]int64]int)
+	}
+	s.fetches = append(s.fetches, time.Now())
+	pass := s.passes[min(s.fetched[[2]int64{gte, lt}], len(s.passes)-1)]
+	s.fetched[[2]int64{gte, lt}]++
+
+	var diffs []Difference
+	for _, d := range pass {
+		if d.RangeStart == gte && d.RangeEnd == lt {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+// runRecheck rechecks the differences against the passes of a scripted source, returning the differences
+// reported and those found to be transient
+func runRecheck(t *testing.T, diffs []Difference, r Recheck, s *scriptedSource) (reported, transient []Difference) {
+	r.Transient = func(d Difference) error {
+		transient = append(transient, d)
+		return nil
+	}
+	reported, err := recheck(context.Background(), diffs, &r, 4, s.fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reported, transient
+}
+
+func TestRecheckReportsPersistingDifferences(t *testing.T) {
+	diffs := []Difference{
+		{ID: 3, Type: Missing, MissingFrom: Secondary, RangeStart: 0, RangeEnd: 10},
+		{ID: 12, Type: Modified, RangeStart: 10, RangeEnd: 20},
+	}
+	s := &scriptedSource{passes: [][]Difference{diffs}}
+	reported, transient := runRecheck(t, diffs, Recheck{Repeats: 2}, s)
+	if !reflect.DeepEqual(reported, diffs) {
+		t.Errorf("got %v, want %v", reported, diffs)
+	}
+	if len(transient) != 0 {
+		t.Errorf("got transient differences %v, want none", transient)
+	}
+
+	// Every pass fetches each of the two ranges once
+	if len(s.fetches) != 6 {
+		t.Errorf("fetched %d ranges, want 6", len(s.fetches))
+	}
+}
+
+func TestRecheckWaitsForReplicationToSettle(t *testing.T) {
+	diffs := []Difference{{ID: 3, Type: Missing, MissingFrom: Secondary, RangeStart: 0, RangeEnd: 10}}
+	s := &scriptedSource{passes: [][]Difference{diffs}}
+	delay := 20 * time.Millisecond
+	start := time.Now()
+	runRecheck(t, diffs, Recheck{Delay: delay, Repeats: 1}, s)
+
+	// The delay is waited before the first pass and between passes
+	if len(s.fetches) != 2 {
+		t.Fatalf("fetched %d times, want 2", len(s.fetches))
+	}
+	if waited := s.fetches[0].Sub(start); waited < delay {
+		t.Errorf("first pass ran after %v, want at least %v", waited, delay)
+	}
+	if waited := s.fetches[1].Sub(s.fetches[0]); waited < delay {
+		t.Errorf("second pass ran %v after the first, want at least %v", waited, delay)
+	}
+}
+
+func TestRecheckReportsTransientDifferences(t *testing.T) {
+	diffs := []Difference{
+		{ID: 3, Type: Missing, MissingFrom: Secondary, RangeStart: 0, RangeEnd: 10},
+		{ID: 5, Type: Missing, MissingFrom: Secondary, RangeStart: 0, RangeEnd: 10},
+		{ID: 5, Type: Duplicate, DuplicatedIn: Primary, Occurrences: 2, RangeStart: 0, RangeEnd: 10},
+		{ID: 14, Type: Modified, RangeStart: 10, RangeEnd: 20},
+	}
+	s := &scriptedSource{passes: [][]Difference{
+		// The duplicate of 5 and the modification of 14 have settled by the first pass
+		{diffs[0], diffs[1]},
+		// 3 has settled by the second pass, and is not reported when it differs again in the third
+		{diffs[1]},
+		{diffs[0], diffs[1]},
+	}}
+	reported, transient := runRecheck(t, diffs, Recheck{Repeats: 2}, s)
+	if want := []Difference{diffs[1]}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("got %v, want %v", reported, want)
+	}
+	if want := []Difference{diffs[2], diffs[3], diffs[0]}; !reflect.DeepEqual(transient, want) {
+		t.Errorf("got transient differences %v, want %v", transient, want)
+	}
+}
+
+func TestRecheckReportsTheLatestObservation(t *testing.T) {
+	// The record missing from the secondary source is replicated with stale fields, then fixed but for one
+	diffs := []Difference{{ID: 3, Type: Missing, MissingFrom: Secondary, RangeStart: 0, RangeEnd: 10}}
+	latest := Difference{ID: 3, Type: Modified, Fields: []string{"email"}, RangeStart: 0, RangeEnd: 10}
+	s := &scriptedSource{passes: [][]Difference{
+		{{ID: 3, Type: Modified, Fields: []string{"email", "name"}, RangeStart: 0, RangeEnd: 10}},
+		// IDs that were not found to differ before are left to the next run
+		{latest, {ID: 4, Type: Missing, MissingFrom: Primary, RangeStart: 0, RangeEnd: 10}},
+	}}
+	reported, transient := runRecheck(t, diffs, Recheck{Repeats: 1}, s)
+	if want := []Difference{latest}; !reflect.DeepEqual(reported, want) {
+		t.Errorf("got %v, want %v", reported, want)
+	}
+	if len(transient) != 0 {
+		t.Errorf("got transient differences %v, want none since ID 3 still differs", transient)
+	}
+}
@@ -0,0 +1,42 @@
+package processing
+
+import "sync"
+
+// ordered passes the differences of the top-level bins to a handler in bin order, as soon as every bin
+// before them is resolved, so that differences are reported while the bins after them are still drilled into
+type ordered struct {
+	handle Handler
+	// keep retains the differences passed to the handler so that they can be returned once every bin is resolved
+	keep bool
+
+	mu       sync.Mutex
+	results  [][]Difference
+	resolved []bool
+	next     int
+}
+
+// expect starts tracking the given number of bins
+func (o *ordered) expect(bins int) {
+	o.results = make([][]Difference, bins)
+	o.resolved = make([]bool, bins)
+}
+
+// resolve records the differences of a bin and passes those of every bin resolved in a row to the handler
+func (o *ordered) resolve(bin int, diffs []Difference) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.results[bin] = diffs
+	o.resolved[bin] = true
+	for ; o.next < len(o.resolved) && o.resolved[o.next]; o.next++ {
+		for _, d := range o.results[o.next] {
+			err := o.handle(d)
+			if err != nil {
+				return err
+			}
+		}
+		if !o.keep {
+			o.results[o.next] = nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package processing
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/arturom/datadiff/datasource"
+)
+
+// SyncOptions configures how differences are applied to the secondary source
+type SyncOptions struct {
+	// BatchSize is the number of records read and written per request
+	BatchSize int
+	// MaxMutations is the most records that may be written or deleted. Nothing is applied when more are needed.
+	MaxMutations int
+	// Delete removes the records found only in the secondary source
+	Delete bool
+	// DryRun passes every batch to the preview without applying it
+	DryRun bool
+}
+
+// Action is the kind of change applied to the secondary source
+type Action int
+
+const (
+	// Write copies records from the primary source
+	Write Action = iota
+	// Delete removes records found only in the secondary source
+	Delete
+)
+
+func (a Action) String() string {
+	if a == Delete {
+		return "delete"
+	}
+	return "write"
+}
+
+// Mutation describes a batch of changes applied to the secondary source
+type Mutation struct {
+	Action Action
+	IDs    []int64
+}
+
+// Sync compares two data sources like Process, then copies the records missing from or modified in the
+// secondary source from the primary source. Records found only in the secondary source are deleted when
+// requested. The primary source must implement datasource.RecordReader and the secondary source
+// datasource.Writer. Every batch is passed to the preview before it is applied.
+func Sync(ctx context.Context, primary, secondary datasource.DataSource, o Options, so SyncOptions, handle Handler, preview func(m Mutation) error) error {
+	reader, ok := primary.(datasource.RecordReader)
+	if !ok || !datasource.ReadsRecords(primary) {
+		return fmt.Errorf("Primary source does not support reading records")
+	}
+	writer, ok := secondary.(datasource.Writer)
+	if !ok {
+		return fmt.Errorf("Secondary source does not support writing records")
+	}
+	if so.BatchSize < 1 {
+		return fmt.Errorf("Batch size must be a positive integer")
+	}
+
+	var writes, deletes []int64
+	err := Process(ctx, primary, secondary, o, func(d Difference) error {
+		if d.Type == Modified || (d.Type == Missing && d.MissingFrom == Secondary) {
+			writes = append(writes, d.ID)
+		} else if d.Type == Missing && so.Delete {
+			deletes = append(deletes, d.ID)
+		}
+		return handle(d)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Refuse before any change is made so that a runaway diff never half-applies
+	if n := len(writes) + len(deletes); n > so.MaxMutations {
+		return fmt.Errorf("Sync needs %d mutations, more than the limit of %d", n, so.MaxMutations)
+	}
+
+	for _, batch := range batches(writes, so.BatchSize) {
+		records, err := reader.ReadRecords(ctx, batch)
+		if err != nil {
+			return err
+		}
+		// Records deleted from the primary since the comparison are skipped
+		ids := make([]int64, 0, len(records))
+		for _, id := range batch {
+			if _, ok := records[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+		err = preview(Mutation{Action: Write, IDs: ids})
+		if err != nil {
+			return err
+		}
+		if !so.DryRun && len(records) != 0 {
+			err = writer.WriteRecords(ctx, records)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, batch := range batches(deletes, so.BatchSize) {
+		err = preview(Mutation{Action: Delete, IDs: batch})
+		if err != nil {
+			return err
+		}
+		if !so.DryRun {
+			err = writer.DeleteRecords(ctx, batch)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// batches splits IDs into slices of at most size IDs
+func batches(ids []int64, size int) [][]int64 {
+	var b [][]int64
+	for len(ids) > size {
+		b = append(b, ids[:size])
+		ids = ids[size:]
+	}
+	if len(ids) != 0 {
+		b = append(b, ids)
+	}
+	return b
+}
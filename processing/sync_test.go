@@ -0,0 +1,124 @@
+package processing
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/arturom/datadiff/datasource"
+)
+
+// recordingWriter compares like the source it wraps and records the changes written to it
+type recordingWriter struct {
+	datasource.DataSource
+	written map[int64]datasource.Record
+	deleted []int64
+}
+
+func (w *recordingWriter) WriteRecords(ctx context.Context, records map[int64]datasource.Record) error {
+	for id, r := range records {
+		w.written[id] = r
+	}
+	return nil
+}
+
+func (w *recordingWriter) DeleteRecords(ctx context.Context, ids []int64) error {
+	w.deleted = append(w.deleted, ids...)
+	return nil
+}
+
+// syncSqlite syncs a copy of IDs 0 to 99 missing 7, 8 and 9 and holding an extra 500 from the full set
+func syncSqlite(t *testing.T, so SyncOptions) (*recordingWriter, []Mutation, error) {
+	primary := openSqlite(t, sqliteTable(t, "primary", idRange(0, 100), nil), sqliteConfig)
+	secondary := &recordingWriter{
+		DataSource: openSqlite(t, sqliteTable(t, "secondary", append(idRange(0, 100, 7, 8, 9), 500), nil), sqliteConfig),
+		written:    make(map[int64]datasource.Record),
+	}
+	var previewed []Mutation
+	err := Sync(context.Background(), primary, secondary, Options{Interval: 10, Branching: 10}, so, func(d Difference) error {
+		return nil
+	}, func(m Mutation) error {
+		previewed = append(previewed, m)
+		return nil
+	})
+	return secondary, previewed, err
+}
+
+func TestSyncWritesAndDeletesInBatches(t *testing.T) {
+	w, previewed, err := syncSqlite(t, SyncOptions{BatchSize: 2, MaxMutations: 4, Delete: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Mutation{
+		{Action: Write, IDs: []int64{7, 8}},
+		{Action: Write, IDs: []int64{9}},
+		{Action: Delete, IDs: []int64{500}},
+	}
+	if !reflect.DeepEqual(previewed, want) {
+		t.Errorf("previewed %v, want %v", previewed, want)
+	}
+	if len(w.written) != 3 || w.written[8]["id"] != int64(8) || w.written[8]["name"] != "record 8" {
+		t.Errorf("wrote %v, want records 7, 8 and 9", w.written)
+	}
+	if !reflect.DeepEqual(w.deleted, []int64{500}) {
+		t.Errorf("deleted %v, want 500", w.deleted)
+	}
+}
+
+func TestSyncDryRunPreviewsWithoutWriting(t *testing.T) {
+	w, previewed, err := syncSqlite(t, SyncOptions{BatchSize: 10, MaxMutations: 4, Delete: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Mutation{
+		{Action: Write, IDs: []int64{7, 8, 9}},
+		{Action: Delete, IDs: []int64{500}},
+	}
+	if !reflect.DeepEqual(previewed, want) {
+		t.Errorf("previewed %v, want %v", previewed, want)
+	}
+	if len(w.written) != 0 || len(w.deleted) != 0 {
+		t.Errorf("dry run wrote %v and deleted %v", w.written, w.deleted)
+	}
+}
+
+func TestSyncRefusesShardsWithoutRecordReader(t *testing.T) {
+	// The second shard only compares, so records routed to it could not be copied
+	shards := datasource.NewShardedDataSource([]datasource.Shard{
+		{Source: openSqlite(t, sqliteTable(t, "low", idRange(0, 50), nil), sqliteConfig), Gte: math.MinInt64, Lt: 50},
+		{Source: &recordingSource{DataSource: openSqlite(t, sqliteTable(t, "high", idRange(50, 100), nil), sqliteConfig)}, Gte: 50, Lt: math.MaxInt64},
+	}, 0)
+	secondary := &recordingWriter{
+		DataSource: openSqlite(t, sqliteTable(t, "secondary", idRange(0, 100, 70), nil), sqliteConfig),
+		written:    make(map[int64]datasource.Record),
+	}
+	err := Sync(context.Background(), shards, secondary, Options{Interval: 10, Branching: 10}, SyncOptions{BatchSize: 10, MaxMutations: 10}, func(d Difference) error {
+		return nil
+	}, func(m Mutation) error {
+		return nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "Primary source does not support reading records") {
+		t.Errorf("got error %v, want the sharded source refused", err)
+	}
+	if len(secondary.written) != 0 {
+		t.Errorf("wrote %v, want nothing written", secondary.written)
+	}
+}
+
+func TestSyncRefusesMoreThanMaxMutations(t *testing.T) {
+	w, previewed, err := syncSqlite(t, SyncOptions{BatchSize: 10, MaxMutations: 3, Delete: true})
+	if err == nil || !strings.Contains(err.Error(), "Sync needs 4 mutations, more than the limit of 3") {
+		t.Fatalf("got error %v, want the mutation limit to be exceeded", err)
+	}
+	if len(previewed) != 0 || len(w.written) != 0 || len(w.deleted) != 0 {
+		t.Errorf("previewed %v, wrote %v and deleted %v past the limit", previewed, w.written, w.deleted)
+	}
+
+	// Without deletes, the three writes are within the limit
+	_, _, err = syncSqlite(t, SyncOptions{BatchSize: 10, MaxMutations: 3})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,39 @@
+package repair
+
+// formats holds the default templates of every format, keyed by the kind of difference they repair
+var formats = map[string]map[string]string{
+	// sql copies missing records from the primary table and removes the records found only in the secondary
+	// table. Both tables must be reachable from the same connection.
+	"sql": {
+		"missing_from_primary":    "DELETE FROM {{.Params.secondary_table}} WHERE {{.Params.field}} = {{.ID}};",
+		"missing_from_secondary":  "INSERT INTO {{.Params.secondary_table}} SELECT * FROM {{.Params.primary_table}} WHERE {{.Params.field}} = {{.ID}};",
+		"modified":                "DELETE FROM {{.Params.secondary_table}} WHERE {{.Params.field}} = {{.ID}};\nINSERT INTO {{.Params.secondary_table}} SELECT * FROM {{.Params.primary_table}} WHERE {{.Params.field}} = {{.ID}};",
+		"duplicated_in_primary":   "",
+		"duplicated_in_secondary": "",
+	},
+	// es-bulk writes a _bulk request deleting the documents found only in the secondary index,
+	// assuming documents are indexed with their numeric ID as _id
+	"es-bulk": {
+		"missing_from_primary":    `{"delete":{"_index":{{json .Params.index}},"_id":"{{.ID}}"}}`,
+		"missing_from_secondary":  "",
+		"modified":                "",
+		"duplicated_in_primary":   "",
+		"duplicated_in_secondary": "",
+	},
+	// mongodb writes shell commands deleting the documents found only in the secondary collection
+	"mongodb": {
+		"missing_from_primary":    `db.getCollection({{json .Params.collection}}).deleteMany({ {{json .Params.field}}: NumberLong("{{.ID}}") });`,
+		"missing_from_secondary":  "",
+		"modified":                "",
+		"duplicated_in_primary":   "",
+		"duplicated_in_secondary": "",
+	},
+	// ids lists every ID the secondary source holds wrongly so that an indexer can re-index it from the primary
+	"ids": {
+		"missing_from_primary":    "{{.ID}}",
+		"missing_from_secondary":  "{{.ID}}",
+		"modified":                "{{.ID}}",
+		"duplicated_in_primary":   "",
+		"duplicated_in_secondary": "{{.ID}}",
+	},
+}
@@ -0,0 +1,200 @@
+package repair
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+	"text/template/parse"
+
+	"github.com/arturom/datadiff/datasource"
+	"github.com/arturom/datadiff/processing"
+)
+
+// Generator turns differences into statements that bring the secondary source in line with the primary
+type Generator struct {
+	buf       *bufio.Writer
+	templates map[string]*template.Template
+	params    map[string]string
+	unsigned  bool
+}
+
+// Config customizes the statements written for a format
+type Config struct {
+	// Params are made available to the templates as .Params, for example table and index names
+	Params map[string]string `json:"params"`
+	// Templates override the default template of a format for each kind of difference.
+	// Kinds are missing_from_primary, missing_from_secondary, modified,
+	// duplicated_in_primary and duplicated_in_secondary. An empty template skips the kind.
+	Templates map[string]string `json:"templates"`
+}
+
+// templateData is passed to the templates, exposing the fields of the difference along with the params.
+// IDs are shadowed by the IDs they are written as, which may not fit an int64 when unsigned.
+type templateData struct {
+	processing.Difference
+	ID         json.Number
+	RangeStart json.Number
+	RangeEnd   json.Number
+	Params     map[string]string
+}
+
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+}
+
+// NewGenerator instantiates a generator based on the format given and a JSON configuration string.
+// The params referenced by the templates must all be given, so that a missing one fails before comparing.
+// Unsigned writes the IDs of the keys compared.
+func NewGenerator(format, config string, w io.Writer, unsigned bool) (*Generator, error) {
+	defaults, ok := formats[format]
+	if !ok {
+		return nil, fmt.Errorf("No repair matching format: %s", format)
+	}
+
+	c := Config{}
+	err := json.Unmarshal([]byte(config), &c)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Generator{
+		buf:       bufio.NewWriter(w),
+		templates: make(map[string]*template.Template),
+		params:    c.Params,
+		unsigned:  unsigned,
+	}
+	for kind, text := range defaults {
+		if override, ok := c.Templates[kind]; ok {
+			text = override
+		}
+		if text == "" {
+			continue
+		}
+		g.templates[kind], err = template.New(kind).
+			Funcs(funcs).
+			Option("missingkey=error").
+			Parse(text)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var missing []string
+	for _, name := range g.requiredParams() {
+		if _, ok := c.Params[name]; !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) != 0 {
+		return nil, fmt.Errorf("Missing params for repair format %s: %s", format, strings.Join(missing, ", "))
+	}
+	for kind := range c.Templates {
+		if _, ok := defaults[kind]; !ok {
+			return nil, fmt.Errorf("No difference matching kind: %s", kind)
+		}
+	}
+	return g, nil
+}
+
+// requiredParams returns the names of the params referenced by the templates, sorted
+func (g *Generator) requiredParams() []string {
+	seen := make(map[string]bool)
+	for _, t := range g.templates {
+		walkParams(t.Tree.Root, seen)
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// walkParams collects the names of the params referenced as .Params.name within a template node
+func walkParams(node parse.Node, seen map[string]bool) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkParams(child, seen)
+		}
+	case *parse.ActionNode:
+		walkParams(n.Pipe, seen)
+	case *parse.PipeNode:
+		if n == nil {
+			return
+		}
+		for _, cmd := range n.Cmds {
+			walkParams(cmd, seen)
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkParams(arg, seen)
+		}
+	case *parse.FieldNode:
+		if len(n.Ident) >= 2 && n.Ident[0] == "Params" {
+			seen[n.Ident[1]] = true
+		}
+	case *parse.IfNode:
+		walkBranch(&n.BranchNode, seen)
+	case *parse.RangeNode:
+		walkBranch(&n.BranchNode, seen)
+	case *parse.WithNode:
+		walkBranch(&n.BranchNode, seen)
+	}
+}
+
+func walkBranch(n *parse.BranchNode, seen map[string]bool) {
+	walkParams(n.Pipe, seen)
+	walkParams(n.List, seen)
+	walkParams(n.ElseList, seen)
+}
+
+// Write writes the statements repairing a single difference, if its kind has a template
+func (g *Generator) Write(d processing.Difference) error {
+	t, ok := g.templates[kind(d)]
+	if !ok {
+		return nil
+	}
+	// Render the whole statement first so that a failing template does not leave half of it in the output
+	var b bytes.Buffer
+	err := t.Execute(&b, templateData{
+		Difference: d,
+		ID:         json.Number(datasource.FormatID(d.ID, g.unsigned)),
+		RangeStart: json.Number(datasource.FormatID(d.RangeStart, g.unsigned)),
+		RangeEnd:   json.Number(datasource.FormatID(d.RangeEnd, g.unsigned)),
+		Params:     g.params,
+	})
+	if err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	_, err = g.buf.Write(b.Bytes())
+	return err
+}
+
+// Close flushes the statements written
+func (g *Generator) Close() error {
+	return g.buf.Flush()
+}
+
+// kind names the kind of a difference as used by the templates
+func kind(d processing.Difference) string {
+	switch d.Type {
+	case processing.Modified:
+		return "modified"
+	case processing.Duplicate:
+		return "duplicated_in_" + d.DuplicatedIn.String()
+	}
+	return "missing_from_" + d.MissingFrom.String()
+}
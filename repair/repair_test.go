@@ -0,0 +1,134 @@
+package repair
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/arturom/datadiff/processing"
+)
+
+// differences holds one difference of every kind
+var differences = []processing.Difference{
+	{ID: 1, Type: processing.Missing, MissingFrom: processing.Primary},
+	{ID: 2, Type: processing.Missing, MissingFrom: processing.Secondary},
+	{ID: 3, Type: processing.Modified},
+	{ID: 4, Type: processing.Duplicate, DuplicatedIn: processing.Primary, Occurrences: 2},
+	{ID: 5, Type: processing.Duplicate, DuplicatedIn: processing.Secondary, Occurrences: 3},
+}
+
+// generate writes the repairs of every kind of difference with a format
+func generate(t *testing.T, format, config string) string {
+	var b bytes.Buffer
+	g, err := NewGenerator(format, config, &b, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range differences {
+		err = g.Write(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = g.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestGeneratorFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		config string
+		want   string
+	}{
+		{
+			"sql",
+			`{"params":{"primary_table":"db1.orders", "secondary_table":"db2.orders", "field":"id"}}`,
+			"DELETE FROM db2.orders WHERE id = 1;\n" +
+				"INSERT INTO db2.orders SELECT * FROM db1.orders WHERE id = 2;\n" +
+				"DELETE FROM db2.orders WHERE id = 3;\n" +
+				"INSERT INTO db2.orders SELECT * FROM db1.orders WHERE id = 3;\n",
+		},
+		{
+			"es-bulk",
+			`{"params":{"index":"orders"}}`,
+			`{"delete":{"_index":"orders","_id":"1"}}` + "\n",
+		},
+		{
+			"mongodb",
+			`{"params":{"collection":"orders", "field":"order.id"}}`,
+			`db.getCollection("orders").deleteMany({ "order.id": NumberLong("1") });` + "\n",
+		},
+		{
+			"ids",
+			`{}`,
+			"1\n2\n3\n5\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := generate(t, tt.format, tt.config); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.format, got, tt.want)
+		}
+	}
+}
+
+func TestGeneratorOverridesTemplates(t *testing.T) {
+	config := `{"params":{"index":"orders"}, "templates":{
+		"missing_from_primary":"",
+		"duplicated_in_secondary":"{\"delete\":{\"_index\":{{json .Params.index}},\"_id\":\"{{.ID}}\"}} {{.Occurrences}}"
+	}}`
+	want := `{"delete":{"_index":"orders","_id":"5"}} 3` + "\n"
+	if got := generate(t, "es-bulk", config); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGeneratorWritesUnsignedIDs(t *testing.T) {
+	var b bytes.Buffer
+	g, err := NewGenerator("sql", `{"params":{"primary_table":"db1.orders", "secondary_table":"db2.orders", "field":"id"}}`, &b, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The key 1 maps the unsigned ID 2^63 + 1
+	err = g.Write(processing.Difference{ID: 1, Type: processing.Missing, MissingFrom: processing.Primary})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = g.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.String(), "DELETE FROM db2.orders WHERE id = 9223372036854775809;\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewGeneratorValidatesConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		config string
+		err    string
+	}{
+		{"format", "csv", `{}`, "No repair matching format: csv"},
+		{"kind", "ids", `{"templates":{"missing":"{{.ID}}"}}`, "No difference matching kind: missing"},
+		{"sql params", "sql", `{"params":{"primary_table":"db1.orders"}}`, "Missing params for repair format sql: field, secondary_table"},
+		{"es-bulk params", "es-bulk", `{}`, "Missing params for repair format es-bulk: index"},
+		{"mongodb params", "mongodb", `{"params":{"field":"id"}}`, "Missing params for repair format mongodb: collection"},
+		{"template params", "ids", `{"templates":{"modified":"{{if .Fields}}{{.Params.table}}{{end}}"}}`, "Missing params for repair format ids: table"},
+	}
+	for _, tt := range tests {
+		_, err := NewGenerator(tt.format, tt.config, &bytes.Buffer{}, false)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+
+	// Params of skipped kinds are not required
+	_, err := NewGenerator("sql", `{"params":{"secondary_table":"orders", "field":"id"}, "templates":{"missing_from_secondary":"", "modified":""}}`, &bytes.Buffer{}, false)
+	if err != nil {
+		t.Errorf("got error %v, want the params of the kept templates to be enough", err)
+	}
+}